@@ -6,4 +6,4 @@ require (
 	golang.org/x/tools v0.23.0
 )
 
-go 1.13
+go 1.18
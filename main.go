@@ -9,16 +9,26 @@ import (
 	"fmt"
 	"go/ast"
 	"go/format"
+	"go/importer"
 	"go/parser"
 	"go/printer"
+	"go/scanner"
 	"go/token"
+	"go/types"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/fatih/camelcase"
 	"github.com/fatih/structtag"
@@ -30,6 +40,36 @@ import (
 type structType struct {
 	name string
 	node *ast.StructType
+	doc  *ast.CommentGroup
+}
+
+// fieldInfo describes the field whose tag is processed
+type fieldInfo struct {
+	name       string
+	structName string // empty for anonymous structs
+	index      int    // 1-based position of the field inside its struct
+	embedded   bool
+	keyOrder   []string // order of the keys shared by the fields of the struct
+	doc        string   // first line of the doc comment
+	baseName   string   // transformed instead of name, see commentName
+
+	// inherited are the tags of the field with the same name promoted by an
+	// embedded struct, see embeddedTags
+	inherited *structtag.Tags
+
+	// transform is used instead of the configured transform, i.e: inferred
+	// from the existing tags of the struct
+	transform string
+}
+
+// lineRange is an inclusive range of lines
+type lineRange struct {
+	start, end int
+}
+
+// tagRename renames the tag with the key from to the key to
+type tagRename struct {
+	from, to string
 }
 
 // output is used usually by editors
@@ -38,6 +78,80 @@ type output struct {
 	End    int      `json:"end"`
 	Lines  []string `json:"lines"`
 	Errors []string `json:"errors,omitempty"`
+
+	// Modified are the fields whose tags are modified, in source order
+	Modified []modifiedField `json:"modified,omitempty"`
+}
+
+// modifiedField is a field whose tag is modified. The tags are without the
+// backticks and empty if the field has no tag.
+type modifiedField struct {
+	Field  string `json:"field"`
+	Line   int    `json:"line"`
+	OldTag string `json:"oldTag"`
+	NewTag string `json:"newTag"`
+}
+
+// textEdit is the change of a tag literal, in the form of a LSP TextEdit
+type textEdit struct {
+	Range   editRange `json:"range"`
+	NewText string    `json:"newText"`
+
+	// start and end are the byte offsets of the range in the source
+	start, end int
+}
+
+// editRange is the range of a textEdit
+type editRange struct {
+	Start editPosition `json:"start"`
+	End   editPosition `json:"end"`
+}
+
+// editPosition is a zero-based line and UTF-16 character offset, as defined
+// by LSP
+type editPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// editorRequest is the request read from stdin with the -editor flag
+type editorRequest struct {
+	File       string           `json:"file"`
+	Source     string           `json:"source,omitempty"`
+	Selection  editorSelection  `json:"selection"`
+	Operations editorOperations `json:"operations"`
+}
+
+// editorSelection selects the fields to be modified, see the -line, -offset,
+// -struct, -field and -all flags
+type editorSelection struct {
+	Line   string `json:"line,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+	Struct string `json:"struct,omitempty"`
+	Field  string `json:"field,omitempty"`
+	All    bool   `json:"all,omitempty"`
+}
+
+// editorOperations are the modifications of an editorRequest, see the flags
+// with the same name
+type editorOperations struct {
+	AddTags        []string `json:"addTags,omitempty"`
+	RemoveTags     []string `json:"removeTags,omitempty"`
+	ClearTags      bool     `json:"clearTags,omitempty"`
+	AddOptions     []string `json:"addOptions,omitempty"`
+	RemoveOptions  []string `json:"removeOptions,omitempty"`
+	ClearOptions   bool     `json:"clearOptions,omitempty"`
+	Transform      string   `json:"transform,omitempty"`
+	Template       string   `json:"template,omitempty"`
+	Sort           bool     `json:"sort,omitempty"`
+	Override       bool     `json:"override,omitempty"`
+	SkipUnexported bool     `json:"skipUnexported,omitempty"`
+}
+
+// editorResponse is the response written to stdout with the -editor flag
+type editorResponse struct {
+	Edits  []textEdit `json:"edits"`
+	Errors []string   `json:"errors,omitempty"`
 }
 
 // config defines how tags should be modified
@@ -45,36 +159,277 @@ type config struct {
 	file     string
 	output   string
 	quiet    bool
+	stat     bool
+	dryRun   bool
+	editor   bool
 	write    bool
+	stamp    bool
 	modified io.Reader
+	stdin    io.Reader // the source, instead of reading the file
+	bom      bool      // the file starts with a UTF-8 BOM
+
+	// fragment parses a source without a package clause, i.e: a struct
+	// snippet, by adding fragmentHeader in front of it
+	fragment bool
+
+	// dir is the directory whose Go files are modified, as with -all. Test
+	// files are only modified with includeTests.
+	dir          string
+	includeTests bool
+	stats        bool // prints the number of scanned files and structs
+
+	// filePattern is a glob the files of dir are filtered by, matched on the
+	// base name or the path relative to dir, i.e: *_linux.go
+	filePattern string
+
+	// inDir is set for the files of dir. They're only written if a tag is
+	// modified and their errors are returned by runDir.
+	inDir bool
+
+	// jsonErrors writes fatal errors as JSON to stdout instead of stderr
+	jsonErrors bool
+
+	// explain writes how the added tag names are derived to, if not nil
+	explain io.Writer
+
+	// debugPositions prints the positions of the structs and fields, to
+	// debug why a selection doesn't match
+	debugPositions bool
+
+	// force continues with the partial AST of a file with syntax errors,
+	// which are reported as warnings in parseErrors
+	force       bool
+	parseErrors scanner.ErrorList
+
+	// mappingReport is the file the mapping is written to, if not empty
+	mappingReport string
+
+	// mapping maps the struct and field names to the tag names of the first
+	// key to be added, it's populated by rewrite
+	mapping map[string]map[string]string
 
 	offset     int
 	structName string
+	occurrence int // 1-based, selects one of the structs named structName
 	fieldName  string
 	line       string
+	lines      string
 	start, end int
 	all        bool
 
+	// selectedStruct limits the modification to the given struct and its
+	// nested structs
+	selectedStruct *ast.StructType
+
+	// selectedFields are the fields selected with -field. Other fields on
+	// their lines aren't modified, i.e: `bar string; qux string`
+	selectedFields []*ast.Field
+
+	// targets are the selected structs and fields, in the form of
+	// "Struct.Field" or "Struct"
+	targets []string
+
+	// structComment selects all structs with a doc comment containing it
+	structComment string
+
+	// structRegex selects all structs whose name matches it
+	structRegex *regexp.Regexp
+
+	// structImplements selects all structs that declare the method with
+	// the given name
+	structImplements string
+
+	// ranges restricts the selection between start and end to the given
+	// line ranges, if any
+	ranges []lineRange
+
 	fset *token.FileSet
+	src  []byte
+
+	// now returns the date of the stamp, time.Now if nil
+	now func() time.Time
+
+	// edits are the changes of the tag literals made by rewrite
+	edits []textEdit
+
+	// structChanges are the structs modified by rewrite
+	structChanges []*structChange
+
+	// structCount is the number of structs of the file seen by rewrite
+	structCount int
+
+	// reports is the number of errors of rewrite that fail the run in every
+	// format, i.e: of -detect-collisions or -max-fields
+	reports int
 
 	remove        []string
 	removeOptions []string
+	keep          []string // all other tags are removed
+	embeddedOnly  bool     // remove and clear tags only of embedded fields
+	pruneEmpty    bool     // remove tags without a name and options
+
+	// removeIgnored are the keys whose tags are removed if they're ignored,
+	// i.e: `json:"-"`
+	removeIgnored []string
+
+	// removeOptionIfLast removes the options only from the tags they're the
+	// sole option of, i.e: json:"name,omitempty" but not json:"name,omitempty,string"
+	removeOptionIfLast bool
+
+	// rename are the keys of tags to be renamed to their new keys, in the
+	// order they're passed
+	rename []tagRename
+
+	// optionSeparators are the separators of the options of the given keys,
+	// used instead of a comma
+	optionSeparators map[string]string
+
+	// optionAliases maps the spelling of an option to the one it's replaced
+	// with
+	optionAliases map[string]string
 
 	add                  []string
 	addOptions           []string
+	createOptionTags     bool // addOptions creates missing tags with an empty name
 	override             bool
 	skipUnexportedFields bool
+	skipInterfaceFields  bool
+	skipFields           *regexp.Regexp // skips the fields whose name matches it
+
+	// importer type checks the imported packages to find the interfaces of
+	// other packages, shared by the files of dir
+	importer *packageImporter
+
+	// dedupe removes the repeated options of a tag
+	dedupe bool
+
+	// atomic leaves all fields unmodified if any field has an error
+	atomic bool
+
+	// noWriteOnError doesn't write the file with -w if any field has an
+	// error, the result is still printed
+	noWriteOnError bool
+
+	// maxFields stops modifying fields once the given number of fields is
+	// modified, if not zero
+	maxFields int
+
+	// commentNames transforms the names of "//name:Ident" comments of the
+	// fields instead of the field names, see commentName
+	commentNames bool
+
+	// inheritEmbedded reuses the tag names of the fields promoted by
+	// embedded structs for the fields with the same name
+	inheritEmbedded bool
+
+	// skipTagValues skips the fields whose tag of the given key has the
+	// given name, i.e: "json" -> "-"
+	skipTagValues map[string]string
+
+	// minimalDiff leaves the tags that are not changed semantically as they
+	// are written
+	minimalDiff bool
+
+	// consistentOrder orders the keys of all fields of a struct the same way
+	consistentOrder bool
+
+	// inferCase transforms the names of the added tags with the dominant
+	// case of the existing tags of a struct, if any
+	inferCase bool
+
+	// collisionKeys are the keys whose tag names are checked for duplicates
+	// among the fields of a struct
+	collisionKeys []string
+
+	// inconsistentCaseKeys are the keys whose tag names are checked for a
+	// mix of cases among the fields of a struct, i.e: snakecase and camelcase
+	inconsistentCaseKeys []string
+
+	// reportMismatches reports existing tags that don't match the derived
+	// names of the keys to be added, without modifying them
+	reportMismatches bool
+
+	// insertPosition defines where new tags are inserted, either at the
+	// "start" or the "end" (default) of the existing tags
+	insertPosition string
 
 	transform   string
 	sort        bool
+	canonical   bool
 	valueFormat string
 	clear       bool
+	clearKeys   []string // clears only the given keys, if not empty
 	clearOption bool
+
+	// sortOrder sorts the tags by the given keys, followed by the other keys
+	// in increasing order
+	sortOrder []string
+
+	// valueFormatByKey is the value format of the given keys, used instead
+	// of valueFormat
+	valueFormatByKey map[string]string
+
+	// valueFormatEmbedded is the value format of embedded fields, used
+	// instead of the other formats
+	valueFormatEmbedded string
+
+	// nameCommand is an external command that returns the name of a field,
+	// used instead of the transform
+	nameCommand string
+
+	// initialisms are kept as a single word when splitting a field name,
+	// i.e: "ACL" for "ACLRules"
+	initialisms []string
+
+	// allowedChars matches a single character allowed in a derived name,
+	// all other characters are replaced with an underscore
+	allowedChars *regexp.Regexp
+
+	// preserveUnderscores keeps the leading, trailing and repeated
+	// underscores of a field name for the snakecase transform
+	preserveUnderscores bool
+
+	// disableEnv disables the expansion of the {env:NAME} placeholder
+	// inside valueFormat
+	disableEnv bool
 }
 
+// errJSONErrors is returned if the error is already written as JSON to
+// stdout
+var errJSONErrors = errors.New("errors are written to stdout")
+
+// stdinFilename is the name of the source read with -stdin, used in the
+// positions of errors
+const stdinFilename = "<standard input>"
+
+// fragmentHeader is added in front of the source with -fragment, so it can be
+// parsed as a file. It's removed from the output.
+const fragmentHeader = "package p\n"
+
+// errDryRun is returned by -dry-run if any field would be modified, so the
+// exit code can be used by hooks
+var errDryRun = errors.New("fields would be modified")
+
+// errNoSelection is returned if none of the flags selecting the fields to
+// modify is passed
+var errNoSelection = errors.New("-line, -lines, -offset, -struct, -struct-with-comment, -struct-regex, " +
+	"-struct-implements, -targets or -all is not passed")
+
+// errMismatches is returned by -report-mismatches if any tag doesn't match
+// the derived name, after the mismatches are reported
+var errMismatches = errors.New("tags don't match the derived names")
+
+// errReported is returned by -detect-collisions, -detect-inconsistent-case,
+// -max-fields and an aborted -atomic run if the errors are included by the
+// json formats
+var errReported = errors.New("fields are reported")
+
 func main() {
 	if err := realMain(); err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
+		if err != errJSONErrors && err != errDryRun && err != errMismatches && err != errReported {
+			// rewrite errors end with a newline already
+			fmt.Fprintln(os.Stderr, strings.TrimSuffix(err.Error(), "\n"))
+		}
 		os.Exit(1)
 	}
 }
@@ -88,749 +443,3864 @@ func realMain() error {
 		return err
 	}
 
-	err = cfg.validate()
+	if cfg.editor {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		return runEditor(os.Stdin, os.Stdout)
+	}
+
+	if cfg.dir != "" {
+		err = cfg.runDir(os.Stdout)
+	} else {
+		err = cfg.run(os.Stdout)
+	}
+	if err != nil && err != errDryRun && err != errMismatches && err != errReported && cfg.jsonErrors {
+		if err := writeJSONErrors(os.Stdout, err); err != nil {
+			return err
+		}
+		return errJSONErrors
+	}
+
+	return err
+}
+
+// run modifies the tags of the selected fields and writes the result to w
+func (c *config) run(w io.Writer) error {
+	err := c.validate()
 	if err != nil {
 		return err
 	}
 
-	node, err := cfg.parse()
+	node, err := c.parse()
 	if err != nil {
 		return err
 	}
 
-	start, end, err := cfg.findSelection(node)
+	for _, err := range c.parseErrors {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+	}
+
+	if c.debugPositions {
+		c.printPositions(os.Stderr, node)
+	}
+
+	start, end, err := c.findSelection(node)
 	if err != nil {
 		return err
 	}
 
-	rewrittenNode, errs := cfg.rewrite(node, start, end)
+	rewrittenNode, errs := c.rewrite(node, start, end)
 	if errs != nil {
 		if _, ok := errs.(*rewriteErrors); !ok {
 			return errs
 		}
 	}
 
-	out, err := cfg.format(rewrittenNode, errs)
+	if c.mappingReport != "" {
+		if err := c.writeMapping(c.mappingReport); err != nil {
+			return err
+		}
+	}
+
+	if c.reportMismatches {
+		if errs == nil {
+			return nil
+		}
+
+		if c.output == "json" || c.output == "json-per-struct" {
+			if err := writeJSONErrors(w, errs); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprint(w, errs.Error())
+		}
+		return errMismatches
+	}
+
+	if c.dryRun {
+		if errs != nil {
+			return errs
+		}
+
+		fields := "fields"
+		if len(c.edits) == 1 {
+			fields = "field"
+		}
+		fmt.Fprintf(w, "%d %s would be modified\n", len(c.edits), fields)
+
+		if len(c.edits) != 0 {
+			return errDryRun
+		}
+		return nil
+	}
+
+	out, err := c.format(rewrittenNode, errs)
 	if err != nil {
 		return err
 	}
 
-	if !cfg.quiet {
-		fmt.Println(out)
+	if c.stat {
+		fmt.Fprintln(w, c.diffStat([]byte(out)))
+	} else if !c.quiet {
+		fmt.Fprintln(w, out)
+	}
+
+	// the file isn't written, which has to fail the run
+	if c.write && c.noWriteOnError && errs != nil {
+		return errs
+	}
+
+	// the reports and the errors -atomic aborts on fail the run
+	if c.reports != 0 || (c.atomic && errs != nil) {
+		if c.output == "json" || c.output == "json-per-struct" {
+			return errReported
+		}
+		return errs
 	}
 	return nil
 }
 
-func parseConfig(args []string) (*config, error) {
-	var (
-		// file flags
-		flagFile  = flag.String("file", "", "Filename to be parsed")
-		flagWrite = flag.Bool("w", false, "Write results to (source) file")
-		flagQuiet = flag.Bool("quiet", false, "Don't print result to stdout")
+// runDir modifies the tags of all structs of the Go files inside the
+// directory and its subdirectories, as with -all. Directories ignored by the
+// go tool, such as vendor and testdata, are skipped. The errors of a file
+// don't stop the walk, they are returned together at the end.
+func (c *config) runDir(w io.Writer) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
 
-		flagOutput = flag.String("format", "source", "Output format."+
-			"By default it's the whole file. Options: [source, json]")
-		flagModified = flag.Bool("modified", false, "read an archive of modified files from standard input")
+	// the files share the imported packages, they're type checked once
+	if c.skipInterfaceFields && c.importer == nil {
+		c.importer = newPackageImporter()
+	}
 
-		// processing modes
-		flagOffset = flag.Int("offset", 0,
-			"Byte offset of the cursor position inside a struct."+
-				"Can be anwhere from the comment until closing bracket")
-		flagLine = flag.String("line", "",
-			"Line number of the field or a range of line. i.e: 4 or 4,8")
-		flagStruct = flag.String("struct", "", "Struct name to be processed")
-		flagField  = flag.String("field", "", "Field name to be processed")
-		flagAll    = flag.Bool("all", false, "Select all structs to be processed")
+	errs := &rewriteErrors{errs: []error{}}
+	modified, reported := 0, error(nil)
+	files, structs, modifiedFiles := 0, 0, 0
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 
-		// tag flags
-		flagRemoveTags = flag.String("remove-tags", "",
-			"Remove tags for the comma separated list of keys")
-		flagClearTags = flag.Bool("clear-tags", false,
-			"Clear all tags")
-		flagAddTags = flag.String("add-tags", "",
-			"Adds tags for the comma separated list of keys."+
-				"Keys can contain a static value, i,e: json:foo")
-		flagOverride             = flag.Bool("override", false, "Override current tags when adding tags")
-		flagSkipUnexportedFields = flag.Bool("skip-unexported", false, "Skip unexported fields")
-		flagTransform            = flag.String("transform", "snakecase",
-			"Transform adds a transform rule when adding tags."+
-				" Current options: [snakecase, camelcase, lispcase, pascalcase, titlecase, keep]")
-		flagSort = flag.Bool("sort", false,
-			"Sort sorts the tags in increasing order according to the key name")
+		name := d.Name()
+		if d.IsDir() {
+			if path != c.dir && (name == "vendor" || name == "testdata" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		// formatting
-		flagFormatting = flag.String("template", "",
-			"Format the given tag's value. i.e: \"column:{field}\", \"field_name={field}\"")
+		if !strings.HasSuffix(name, ".go") || (strings.HasSuffix(name, "_test.go") && !c.includeTests) {
+			return nil
+		}
 
-		// option flags
-		flagRemoveOptions = flag.String("remove-options", "",
-			"Remove the comma separated list of options from the given keys, "+
-				"i.e: json=omitempty,hcl=squash")
-		flagClearOptions = flag.Bool("clear-options", false,
-			"Clear all tag options")
-		flagAddOptions = flag.String("add-options", "",
-			"Add the options per given key. i.e: json=omitempty,hcl=squash")
-	)
+		if c.filePattern != "" && !c.matchFile(path) {
+			return nil
+		}
 
-	// this fails if there are flags re-defined with the same name.
-	if err := flag.CommandLine.Parse(args); err != nil {
-		return nil, err
-	}
+		files++
 
-	if flag.NFlag() == 0 {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
-		return nil, flag.ErrHelp
-	}
+		fc := *c
+		fc.dir = ""
+		fc.stats = false
+		fc.filePattern = ""
+		fc.file = path
+		fc.all = true
+		fc.inDir = true
 
-	cfg := &config{
-		file:                 *flagFile,
-		line:                 *flagLine,
-		structName:           *flagStruct,
-		fieldName:            *flagField,
-		offset:               *flagOffset,
-		all:                  *flagAll,
-		output:               *flagOutput,
-		write:                *flagWrite,
-		quiet:                *flagQuiet,
-		clear:                *flagClearTags,
-		clearOption:          *flagClearOptions,
-		transform:            *flagTransform,
-		sort:                 *flagSort,
-		valueFormat:          *flagFormatting,
-		override:             *flagOverride,
-		skipUnexportedFields: *flagSkipUnexportedFields,
+		// the written files aren't printed, except their diffs
+		if c.write && c.output != "diff" {
+			fc.quiet = true
+		}
+
+		out := w
+		if c.dryRun {
+			// only the total is printed
+			out = ioutil.Discard
+		}
+
+		err = fc.run(out)
+		if err == errMismatches || err == errReported {
+			// the fields are already reported
+			reported = err
+			return nil
+		}
+
+		if err != nil && err != errDryRun {
+			// syntax errors are already prefixed with the file name
+			if !strings.HasPrefix(err.Error(), path) {
+				err = fmt.Errorf("%s: %s", path, err)
+			}
+			errs.Append(err)
+			return nil
+		}
+
+		for _, sc := range fc.structChanges {
+			for _, e := range sc.errs {
+				errs.Append(errors.New(e))
+			}
+		}
+
+		structs += fc.structCount
+		modified += len(fc.edits)
+		if len(fc.edits) != 0 {
+			modifiedFiles++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	if *flagModified {
-		cfg.modified = os.Stdin
+	if c.stats {
+		// the files are only modified if they're written
+		verb := "would modify"
+		if c.write && !c.dryRun {
+			verb = "modified"
+		}
+		fmt.Fprintf(w, "scanned %d files, %d structs, %s %d files\n",
+			files, structs, verb, modifiedFiles)
 	}
 
-	if *flagAddTags != "" {
-		cfg.add = strings.Split(*flagAddTags, ",")
+	if len(errs.errs) != 0 {
+		return errs
 	}
 
-	if *flagAddOptions != "" {
-		cfg.addOptions = strings.Split(*flagAddOptions, ",")
+	if reported != nil {
+		return reported
 	}
 
-	if *flagRemoveTags != "" {
-		cfg.remove = strings.Split(*flagRemoveTags, ",")
+	if c.dryRun {
+		fields := "fields"
+		if modified == 1 {
+			fields = "field"
+		}
+		fmt.Fprintf(w, "%d %s would be modified\n", modified, fields)
+
+		if modified != 0 {
+			return errDryRun
+		}
 	}
 
-	if *flagRemoveOptions != "" {
-		cfg.removeOptions = strings.Split(*flagRemoveOptions, ",")
+	return nil
+}
+
+// printPositions prints the name, lines and offsets of each struct of the
+// given node, followed by the positions of its fields, in source order
+func (c *config) printPositions(w io.Writer, node ast.Node) {
+	var structs []*structType
+	for _, st := range collectStructs(node) {
+		structs = append(structs, st)
 	}
 
-	return cfg, nil
+	sort.Slice(structs, func(i, j int) bool {
+		return structs[i].node.Pos() < structs[j].node.Pos()
+	})
 
-}
+	for _, st := range structs {
+		start := c.fset.Position(st.node.Pos())
+		end := c.fset.Position(st.node.End())
 
-func (c *config) parse() (ast.Node, error) {
-	c.fset = token.NewFileSet()
-	var contents interface{}
-	if c.modified != nil {
-		archive, err := buildutil.ParseOverlayArchive(c.modified)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse -modified archive: %v", err)
+		name := st.name
+		if name == "" {
+			name = "<anonymous>"
 		}
-		fc, ok := archive[c.file]
-		if !ok {
-			return nil, fmt.Errorf("couldn't find %s in archive", c.file)
+
+		fmt.Fprintf(w, "struct %s: lines %d-%d, offsets %d-%d\n",
+			name, start.Line, end.Line, start.Offset, end.Offset)
+
+		for _, f := range st.node.Fields.List {
+			pos := c.fset.Position(f.Pos())
+
+			var names []string
+			for _, n := range f.Names {
+				names = append(names, n.Name)
+			}
+			if len(names) == 0 {
+				names = []string{"<embedded>"}
+			}
+
+			fmt.Fprintf(w, "\tfield %s: line %d, column %d, offset %d\n",
+				strings.Join(names, ", "), pos.Line, pos.Column, pos.Offset)
+		}
+	}
+}
+
+// writeJSONErrors writes a fatal error as a JSON object in the form of
+// {"errors":[...]}, so editors can parse the same output as for -format json
+func writeJSONErrors(w io.Writer, err error) error {
+	var errs []string
+	if rwErrs, ok := err.(*rewriteErrors); ok {
+		for _, e := range rwErrs.errs {
+			errs = append(errs, e.Error())
 		}
-		contents = fc
+	} else {
+		errs = []string{err.Error()}
 	}
 
-	return parser.ParseFile(c.fset, c.file, contents, parser.ParseComments)
+	return json.NewEncoder(w).Encode(struct {
+		Errors []string `json:"errors"`
+	}{Errors: errs})
 }
 
-// findSelection returns the start and end position of the fields that are
+// runEditor reads an editorRequest from r, processes it and writes the
+// editorResponse to w. Errors of the request are part of the response.
+func runEditor(r io.Reader, w io.Writer) error {
+	var req editorRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return fmt.Errorf("failed to decode the editor request: %v", err)
+	}
+
+	resp := editorResponse{Edits: []textEdit{}}
+	edits, err := req.config().editorEdits()
+	if err != nil {
+		if rwErrs, ok := err.(*rewriteErrors); ok {
+			for _, e := range rwErrs.errs {
+				resp.Errors = append(resp.Errors, e.Error())
+			}
+		} else {
+			resp.Errors = []string{err.Error()}
+		}
+	}
+	if edits != nil {
+		resp.Edits = edits
+	}
+
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// config returns the config of the request
+func (r *editorRequest) config() *config {
+	cfg := &config{
+		file:                 r.File,
+		output:               "text-edits",
+		line:                 r.Selection.Line,
+		offset:               r.Selection.Offset,
+		structName:           r.Selection.Struct,
+		fieldName:            r.Selection.Field,
+		all:                  r.Selection.All,
+		add:                  r.Operations.AddTags,
+		remove:               r.Operations.RemoveTags,
+		clear:                r.Operations.ClearTags,
+		addOptions:           r.Operations.AddOptions,
+		removeOptions:        r.Operations.RemoveOptions,
+		clearOption:          r.Operations.ClearOptions,
+		transform:            r.Operations.Transform,
+		valueFormat:          r.Operations.Template,
+		sort:                 r.Operations.Sort,
+		override:             r.Operations.Override,
+		skipUnexportedFields: r.Operations.SkipUnexported,
+	}
+
+	if cfg.transform == "" {
+		cfg.transform = "snakecase"
+	}
+
+	// the source of an unsaved file
+	if r.Source != "" {
+		cfg.src = []byte(r.Source)
+	}
+
+	return cfg
+}
+
+// editorEdits runs the whole pipeline and returns the text edits of the
+// modified tags. The returned error can be a *rewriteErrors together with the
+// edits of the fields that succeeded.
+func (c *config) editorEdits() ([]textEdit, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	node, err := c.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, err := c.findSelection(node)
+	if err != nil {
+		return nil, err
+	}
+
+	_, errs := c.rewrite(node, start, end)
+	return c.edits, errs
+}
+
+// applyConfigFile sets the flags of fs that aren't passed explicitly to the
+// values of the given JSON file. The keys of the file are flag names, the
+// values are strings, booleans, numbers or lists of strings, which are joined
+// by a comma, i.e: {"add-tags": ["json", "xml"], "sort": true}. Lines starting
+// with "//" are comments.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "//") {
+			lines[i] = ""
+		}
+	}
+
+	dec := json.NewDecoder(strings.NewReader(strings.Join(lines, "\n")))
+	dec.UseNumber()
+
+	var values map[string]interface{}
+	if err := dec.Decode(&values); err != nil {
+		return fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+
+	passed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		passed[f.Name] = true
+	})
+
+	// sort the names for a deterministic error
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("config file %s: unknown flag %q", path, name)
+		}
+
+		if passed[name] {
+			continue
+		}
+
+		var value string
+		switch v := values[name].(type) {
+		case string:
+			value = v
+		case bool:
+			value = strconv.FormatBool(v)
+		case json.Number:
+			value = v.String()
+		case []interface{}:
+			var list []string
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("config file %s: flag %q must be a list of strings", path, name)
+				}
+				list = append(list, s)
+			}
+			value = strings.Join(list, ",")
+		default:
+			return fmt.Errorf("config file %s: flag %q has an invalid value %v", path, name, v)
+		}
+
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config file %s: invalid value %q for flag %q: %s", path, value, name, err)
+		}
+	}
+
+	return nil
+}
+
+// hiddenFlags are not part of the usage message, i.e: debugging aids for tool
+// authors
+var hiddenFlags = map[string]bool{
+	"debug-positions": true,
+}
+
+// usage prints the usage message of -h and of a run without flags
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	printDefaults()
+}
+
+// printDefaults prints the defaults of all flags except the hidden ones
+func printDefaults() {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(flag.CommandLine.Output())
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.PrintDefaults()
+}
+
+func parseConfig(args []string) (*config, error) {
+	var (
+		// file flags
+		flagFile  = flag.String("file", "", "Filename to be parsed")
+		flagDir   = flag.String("dir", "", "Directory whose Go files are parsed recursively, as with -all")
+		flagWrite = flag.Bool("w", false, "Write results to (source) file")
+		flagQuiet = flag.Bool("quiet", false, "Don't print result to stdout")
+		flagStat  = flag.Bool("stat", false,
+			"Print the number of added and removed lines and hunks instead of the source")
+		flagIncludeTests = flag.Bool("include-tests", false,
+			"Modify the _test.go files of -dir as well")
+		flagFilePattern = flag.String("file-pattern", "",
+			"Modify only the files of -dir whose name or relative path matches the glob, i.e: *_linux.go")
+		flagStats = flag.Bool("stats", false,
+			"Print the number of scanned files and structs and the number of modified files of -dir")
+		flagDryRun = flag.Bool("dry-run", false,
+			"Print the number of fields that would be modified and exit with 1 if any, without printing or writing the source")
+		flagStamp = flag.Bool("stamp", false,
+			"Add a comment with the date of the modification above the package clause, if any tag is modified (source format only)")
+		flagConfig = flag.String("config", "",
+			"JSON file with the default values of flags, by flag name. i.e: {\"transform\": \"camelcase\", \"sort\": true}")
+
+		flagOutput = flag.String("format", "source", "Output format."+
+			"By default it's the whole file. Options: [source, diff, json, json-per-struct, text-edits, yaml]")
+		flagModified = flag.Bool("modified", false, "read an archive of modified files from standard input")
+		flagStdin    = flag.Bool("stdin", false, "read the source from standard input and print the result")
+		flagEditor   = flag.Bool("editor", false,
+			"Read a JSON request from standard input and write the text edits as a JSON response")
+		flagJSONErrors = flag.Bool("json-errors", false,
+			"Write fatal errors as a JSON object to stdout instead of stderr, i.e: for -format json")
+		flagDebugPositions = flag.Bool("debug-positions", false,
+			"Print the positions of all structs and fields to stderr")
+		flagExplain = flag.Bool("explain", false,
+			"Print the transform and the template each added tag name is derived by to stderr")
+		flagForce = flag.Bool("force", false,
+			"Modify the selection of a file with syntax errors, which are reported as warnings")
+		flagFragment = flag.Bool("fragment", false,
+			"Parse the source as declarations without a package clause, i.e: a struct snippet (source format only)")
+		flagMappingReport = flag.String("mapping-report", "",
+			"Write the tag names of the first -add-tags key of each field to the given file, "+
+				"i.e: {\"Struct\":{\"Field\":\"tag_name\"}}")
+
+		// processing modes
+		flagOffset = flag.Int("offset", 0,
+			"Byte offset of the cursor position inside a struct."+
+				"Can be anwhere from the comment until closing bracket")
+		flagLine = flag.String("line", "",
+			"Line number of the field or a range of line. i.e: 4 or 4,8. Multiple ranges are separated by a semicolon, i.e: 4,8;10,12")
+		flagLines = flag.String("lines", "",
+			"Comma separated list of line numbers of the fields. i.e: 4,7,9")
+		flagStruct = flag.String("struct", "", "Struct name to be processed")
+		flagField  = flag.String("field", "", "Field name to be processed")
+		flagAll    = flag.Bool("all", false, "Select all structs to be processed")
+
+		flagStructComment = flag.String("struct-with-comment", "",
+			"Select all structs whose doc comment contains the given marker, i.e: @entity")
+		flagStructRegex = flag.String("struct-regex", "",
+			"Select all structs whose name matches the given regular expression, i.e: DTO$")
+		flagStructImplements = flag.String("struct-implements", "",
+			"Select all structs that declare the given method, i.e: IsEntity")
+		flagTargets = flag.String("targets", "",
+			"File with a list of structs and fields to be processed, one per line. i.e: Server.Name or Server")
+		flagOccurrence = flag.Int("occurrence", 0,
+			"Select the Nth struct in source order if multiple structs have the -struct name")
+
+		// tag flags
+		flagRemoveTags = flag.String("remove-tags", "",
+			"Remove tags for the comma separated list of keys")
+		flagClearTags = flag.Bool("clear-tags", false,
+			"Clear all tags")
+		flagClearKeys = flag.String("clear-keys", "",
+			"Clear the tags of the comma separated list of keys, i.e: json,xml")
+		flagEmbeddedOnly = flag.Bool("embedded-only", false,
+			"Remove or clear tags only of embedded fields")
+		flagRenameTags = flag.String("rename-tags", "",
+			"Rename the keys of tags, keeping their values, i.e: bson:json")
+		flagRemoveIgnored = flag.String("remove-ignored", "",
+			"Remove the tags of the comma separated list of keys whose name is \"-\", i.e: json:\"-\"")
+		flagKeepTags = flag.String("keep-tags", "",
+			"Remove all tags except the comma separated list of keys")
+		flagPruneEmptyTags = flag.Bool("prune-empty-tags", false,
+			"Remove tags without a name and options, i.e: json:\"\" after removing the options of json:\",omitempty\"")
+		flagAddTags = flag.String("add-tags", "",
+			"Adds tags for the comma separated list of keys."+
+				"Keys can contain a static value, i,e: json:foo")
+		flagAtomic = flag.Bool("atomic", false,
+			"Don't modify any field if one of the fields has an error, i.e: an invalid tag")
+		flagNoWriteOnError = flag.Bool("no-write-on-error", false,
+			"Don't write the file with -w if one of the fields has an error, i.e: an invalid tag")
+		flagMaxFields = flag.Int("max-fields", 0,
+			"Stop after modifying the given number of fields, the other fields are reported and left as they are")
+		flagCommentNames = flag.Bool("comment-names", false,
+			"Transform the name of a \"//name:Ident\" comment of a field instead of the field name")
+		flagInheritEmbedded = flag.Bool("inherit-embedded-tags", false,
+			"Reuse the tag names of the fields promoted by embedded structs of the same file for the fields with the same name")
+		flagOverride             = flag.Bool("override", false, "Override current tags when adding tags")
+		flagSkipUnexportedFields = flag.Bool("skip-unexported", false, "Skip unexported fields")
+		flagSkipInterfaceFields  = flag.Bool("skip-interfaces", false, "Skip fields of an interface type")
+		flagSkipFields           = flag.String("skip-fields", "", "Skip fields whose name matches the regular expression, i.e: ^XXX_")
+		flagTransform            = flag.String("transform", "snakecase",
+			"Transform adds a transform rule when adding tags."+
+				" Current options: [snakecase, screamingsnake, camelcase, lispcase, pascalcase, titlecase, keep, gojson]")
+		flagSkipTagValues = flag.String("skip-tag-values", "",
+			"Skip the fields whose tag has the given name, for the comma separated list of keys. i.e: json=-")
+		flagNameCommand = flag.String("name-command", "",
+			"Command that returns the tag name of a field instead of the transform. "+
+				"It reads the struct and field name from stdin, each on a separate line")
+		flagInitialisms = flag.String("initialisms", "",
+			"Comma separated list of initialisms that are transformed as a single word, i.e: API,URL,ACL")
+		flagAllowedChars = flag.String("allowed-chars", "",
+			"Regular expression of a single character allowed in a derived tag name, "+
+				"other characters are replaced with an underscore. i.e: [a-z0-9_]")
+		flagPreserveUnderscores = flag.Bool("preserve-underscores", false,
+			"Keep leading, trailing and repeated underscores of field names with the snakecase transform")
+		flagSort = flag.Bool("sort", false,
+			"Sort sorts the tags in increasing order according to the key name")
+		flagSortOrder = flag.String("sort-order", "",
+			"Sort the tags by the comma separated list of keys, followed by the other keys in increasing order, i.e: json,yaml,db")
+		flagCanonical = flag.Bool("canonical", false,
+			"Rewrite the tags in a canonical form: sorted keys, sorted and trimmed options")
+		flagInsertPosition = flag.String("insert-position", "end",
+			"Position of the new tags relative to the existing tags. Options: [start, end]")
+		flagMinimalDiff = flag.Bool("minimal-diff", false,
+			"Only rewrite tags that change, i.e: keep the whitespace between the keys of unchanged tags")
+		flagConsistentOrder = flag.Bool("consistent-order", false,
+			"Order the keys of the tags of a struct the same way, following the order most fields use")
+		flagInferCase = flag.Bool("infer-case", false,
+			"Use the dominant case of the existing tags of a struct instead of -transform, if any")
+		flagDetectCollisions = flag.String("detect-collisions", "",
+			"Report fields of a struct with the same tag name for the comma separated list of keys, i.e: json")
+		flagDetectInconsistentCase = flag.String("detect-inconsistent-case", "",
+			"Report fields of a struct whose tag names differ from the case of the other fields for the comma separated list of keys, i.e: json")
+		flagReportMismatches = flag.Bool("report-mismatches", false,
+			"Report existing tags of the -add-tags keys that don't match the derived name, without modifying them")
+
+		// formatting
+		flagFormatting = flag.String("template", "",
+			"Format the given tag's value. i.e: \"column:{field}\", \"field_name={field}\", \"{struct}.{field}\", \"{index}\". "+
+				"{env:NAME} is replaced with the environment variable NAME")
+		flagFormattingEmbedded = flag.String("template-embedded", "",
+			"Format the value of embedded fields, used instead of the other templates. i.e: \",squash\"")
+		flagFormattingByKey = flag.String("template-by-key", "",
+			"Format the value of the given keys, used instead of -template. "+
+				"i.e: \"json={field},db=column:{field}\"")
+		flagNoEnv = flag.Bool("no-env", false,
+			"Don't replace the {env:NAME} placeholder of the templates with the environment variable")
+
+		// option flags
+		flagRemoveOptions = flag.String("remove-options", "",
+			"Remove the comma separated list of options from the given keys, "+
+				"i.e: json=omitempty,hcl=squash")
+		flagRemoveOptionIfLast = flag.Bool("remove-option-if-last", false,
+			"Remove the options of -remove-options only if they're the sole option of the tag")
+		flagClearOptions = flag.Bool("clear-options", false,
+			"Clear all tag options")
+		flagAddOptions = flag.String("add-options", "",
+			"Add the options per given key. i.e: json=omitempty,hcl=squash")
+		flagCreateOptionTags = flag.Bool("create-option-tags", false,
+			"Create the missing tags of -add-options with an empty name, i.e: json:\",omitempty\"")
+		flagDedupeOptions = flag.Bool("dedupe-options", false,
+			"Remove the repeated options of each tag, i.e: json:\"foo,omitempty,omitempty\"")
+		flagOptionSeparators = flag.String("option-separators", "",
+			"Separators of the options of the given keys instead of a comma, "+
+				"i.e: \"gorm=;\"")
+		flagOptionAliases = flag.String("option-aliases", "",
+			"Replace the spelling of options with the comma separated list of aliases, "+
+				"i.e: \"not null=notNull\"")
+	)
+
+	// -h lists the flags without the hidden ones
+	flag.CommandLine.Usage = usage
+
+	// this fails if there are flags re-defined with the same name.
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if flag.NFlag() == 0 {
+		usage()
+		return nil, flag.ErrHelp
+	}
+
+	if *flagConfig != "" {
+		if err := applyConfigFile(flag.CommandLine, *flagConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &config{
+		file:                 *flagFile,
+		line:                 *flagLine,
+		lines:                *flagLines,
+		structName:           *flagStruct,
+		occurrence:           *flagOccurrence,
+		structComment:        *flagStructComment,
+		structImplements:     *flagStructImplements,
+		removeOptionIfLast:   *flagRemoveOptionIfLast,
+		fieldName:            *flagField,
+		offset:               *flagOffset,
+		all:                  *flagAll,
+		output:               *flagOutput,
+		write:                *flagWrite,
+		quiet:                *flagQuiet,
+		stat:                 *flagStat,
+		dir:                  *flagDir,
+		includeTests:         *flagIncludeTests,
+		filePattern:          *flagFilePattern,
+		stats:                *flagStats,
+		dryRun:               *flagDryRun,
+		editor:               *flagEditor,
+		jsonErrors:           *flagJSONErrors,
+		mappingReport:        *flagMappingReport,
+		force:                *flagForce,
+		debugPositions:       *flagDebugPositions,
+		stamp:                *flagStamp,
+		clear:                *flagClearTags,
+		clearOption:          *flagClearOptions,
+		transform:            *flagTransform,
+		nameCommand:          *flagNameCommand,
+		sort:                 *flagSort,
+		canonical:            *flagCanonical,
+		valueFormat:          *flagFormatting,
+		valueFormatEmbedded:  *flagFormattingEmbedded,
+		override:             *flagOverride,
+		skipUnexportedFields: *flagSkipUnexportedFields,
+		skipInterfaceFields:  *flagSkipInterfaceFields,
+		preserveUnderscores:  *flagPreserveUnderscores,
+		insertPosition:       *flagInsertPosition,
+		reportMismatches:     *flagReportMismatches,
+		inferCase:            *flagInferCase,
+		consistentOrder:      *flagConsistentOrder,
+		minimalDiff:          *flagMinimalDiff,
+		pruneEmpty:           *flagPruneEmptyTags,
+		embeddedOnly:         *flagEmbeddedOnly,
+		dedupe:               *flagDedupeOptions,
+		atomic:               *flagAtomic,
+		fragment:             *flagFragment,
+		createOptionTags:     *flagCreateOptionTags,
+		noWriteOnError:       *flagNoWriteOnError,
+		inheritEmbedded:      *flagInheritEmbedded,
+		commentNames:         *flagCommentNames,
+		maxFields:            *flagMaxFields,
+		disableEnv:           *flagNoEnv,
+	}
+
+	if *flagModified {
+		cfg.modified = os.Stdin
+	}
+
+	if *flagStdin {
+		cfg.stdin = os.Stdin
+		if cfg.file == "" {
+			cfg.file = stdinFilename
+		}
+	}
+
+	if *flagExplain {
+		cfg.explain = os.Stderr
+	}
+
+	if *flagAddTags != "" {
+		cfg.add = strings.Split(*flagAddTags, ",")
+	}
+
+	if *flagClearKeys != "" {
+		cfg.clearKeys = strings.Split(*flagClearKeys, ",")
+	}
+
+	if *flagDetectCollisions != "" {
+		cfg.collisionKeys = strings.Split(*flagDetectCollisions, ",")
+	}
+
+	if *flagDetectInconsistentCase != "" {
+		cfg.inconsistentCaseKeys = strings.Split(*flagDetectInconsistentCase, ",")
+	}
+
+	if *flagNameCommand != "" && len(strings.Fields(*flagNameCommand)) == 0 {
+		return nil, errors.New("-name-command is blank")
+	}
+
+	if *flagStructRegex != "" {
+		re, err := regexp.Compile(*flagStructRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -struct-regex: %s", err)
+		}
+		cfg.structRegex = re
+	}
+
+	if *flagSkipFields != "" {
+		re, err := regexp.Compile(*flagSkipFields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -skip-fields: %s", err)
+		}
+		cfg.skipFields = re
+	}
+
+	if *flagAllowedChars != "" {
+		allowed, err := regexp.Compile(*flagAllowedChars)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -allowed-chars: %s", err)
+		}
+		cfg.allowedChars = allowed
+	}
+
+	if *flagInitialisms != "" {
+		cfg.initialisms = strings.Split(*flagInitialisms, ",")
+	}
+
+	if *flagAddOptions != "" {
+		cfg.addOptions = strings.Split(*flagAddOptions, ",")
+	}
+
+	if *flagRemoveTags != "" {
+		cfg.remove = strings.Split(*flagRemoveTags, ",")
+	}
+
+	if *flagSkipTagValues != "" {
+		cfg.skipTagValues = make(map[string]string)
+		for _, val := range strings.Split(*flagSkipTagValues, ",") {
+			// syntax key=name
+			splitted := strings.SplitN(val, "=", 2)
+			if len(splitted) < 2 {
+				return nil, errors.New("wrong syntax to skip a tag value. i.e key=name")
+			}
+
+			cfg.skipTagValues[splitted[0]] = splitted[1]
+		}
+	}
+
+	if *flagTargets != "" {
+		targets, err := readTargets(*flagTargets)
+		if err != nil {
+			return nil, err
+		}
+		cfg.targets = targets
+	}
+
+	if *flagRenameTags != "" {
+		for _, val := range strings.Split(*flagRenameTags, ",") {
+			// syntax old:new
+			splitted := strings.SplitN(val, ":", 2)
+			if len(splitted) < 2 || splitted[0] == "" || splitted[1] == "" {
+				return nil, errors.New("wrong syntax to rename a tag. i.e old:new")
+			}
+
+			cfg.rename = append(cfg.rename, tagRename{from: splitted[0], to: splitted[1]})
+		}
+	}
+
+	if *flagSortOrder != "" {
+		cfg.sortOrder = strings.Split(*flagSortOrder, ",")
+	}
+
+	if *flagRemoveIgnored != "" {
+		cfg.removeIgnored = strings.Split(*flagRemoveIgnored, ",")
+	}
+
+	if *flagKeepTags != "" {
+		cfg.keep = strings.Split(*flagKeepTags, ",")
+	}
+
+	if *flagRemoveOptions != "" {
+		cfg.removeOptions = strings.Split(*flagRemoveOptions, ",")
+	}
+
+	if *flagOptionSeparators != "" {
+		cfg.optionSeparators = make(map[string]string)
+		for _, val := range strings.Split(*flagOptionSeparators, ",") {
+			// syntax key=separator
+			splitted := strings.SplitN(val, "=", 2)
+			if len(splitted) < 2 || splitted[1] == "" {
+				return nil, errors.New("wrong syntax to set an option separator. i.e key=;")
+			}
+
+			cfg.optionSeparators[splitted[0]] = splitted[1]
+		}
+	}
+
+	if *flagOptionAliases != "" {
+		cfg.optionAliases = make(map[string]string)
+		for _, val := range strings.Split(*flagOptionAliases, ",") {
+			// syntax option=alias
+			splitted := strings.SplitN(val, "=", 2)
+			if len(splitted) < 2 {
+				return nil, errors.New("wrong syntax to alias an option. i.e option=alias")
+			}
+
+			cfg.optionAliases[splitted[0]] = splitted[1]
+		}
+	}
+
+	if *flagFormattingByKey != "" {
+		cfg.valueFormatByKey = make(map[string]string)
+		for _, val := range strings.Split(*flagFormattingByKey, ",") {
+			// syntax key=template
+			splitted := strings.SplitN(val, "=", 2)
+			if len(splitted) < 2 {
+				return nil, errors.New("wrong syntax to format a key. i.e key=template")
+			}
+
+			cfg.valueFormatByKey[splitted[0]] = splitted[1]
+		}
+	}
+
+	return cfg, nil
+
+}
+
+// readTargets reads the targets from the given file, one per line. Empty lines
+// are skipped.
+func readTargets(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		targets = append(targets, line)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets found in %s", filename)
+	}
+
+	return targets, nil
+}
+
+// utf8BOM is the byte order mark some editors add at the beginning of a file
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func (c *config) parse() (ast.Node, error) {
+	c.fset = token.NewFileSet()
+	if c.modified != nil {
+		archive, err := buildutil.ParseOverlayArchive(c.modified)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse -modified archive: %v", err)
+		}
+		fc, ok := archive[c.file]
+		if !ok {
+			return nil, fmt.Errorf("couldn't find %s in archive", c.file)
+		}
+		c.src = fc
+	} else if c.stdin != nil {
+		src, err := ioutil.ReadAll(c.stdin)
+		if err != nil {
+			return nil, err
+		}
+		c.src = src
+	} else if c.src == nil {
+		src, err := ioutil.ReadFile(c.file)
+		if err != nil {
+			return nil, err
+		}
+		c.src = src
+	}
+
+	// the BOM is not part of the source, it's added back when the file is
+	// written
+	if bytes.HasPrefix(c.src, utf8BOM) {
+		c.src = c.src[len(utf8BOM):]
+		c.bom = true
+	}
+
+	if c.fragment {
+		return c.parseFragment()
+	}
+
+	node, err := parser.ParseFile(c.fset, c.file, c.src, parser.ParseComments)
+	if err != nil && c.force && node != nil {
+		// continue with the partial AST, the selected struct might be fine
+		if list, ok := err.(scanner.ErrorList); ok {
+			c.parseErrors = list
+			return node, nil
+		}
+	}
+
+	return node, err
+}
+
+// parseFragment parses the source as the declarations of a file without the
+// package clause. The lines of the positions are those of the fragment.
+func (c *config) parseFragment() (ast.Node, error) {
+	c.src = append([]byte(fragmentHeader), c.src...)
+
+	node, err := parser.ParseFile(c.fset, c.file, c.src, parser.ParseComments)
+	if list, ok := err.(scanner.ErrorList); ok {
+		for _, e := range list {
+			e.Pos.Line--
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the line after the header is the first line of the fragment
+	c.fset.File(node.Pos()).AddLineColumnInfo(len(fragmentHeader), c.file, 1, 1)
+	return node, nil
+}
+
+// findSelection returns the start and end position of the fields that are
 // suspect to change. It depends on the line, struct or offset selection.
 func (c *config) findSelection(node ast.Node) (int, int, error) {
-	if c.line != "" {
+	if c.line != "" && c.structName != "" {
+		return c.structLineSelection(node)
+	} else if c.line != "" {
 		return c.lineSelection(node)
+	} else if c.lines != "" {
+		return c.linesSelection(node)
 	} else if c.offset != 0 {
 		return c.offsetSelection(node)
+	} else if len(c.targets) != 0 {
+		return c.targetsSelection(node)
 	} else if c.structName != "" {
 		return c.structSelection(node)
+	} else if c.structComment != "" {
+		return c.structCommentSelection(node)
+	} else if c.structRegex != nil {
+		return c.structRegexSelection(node)
+	} else if c.structImplements != "" {
+		return c.structImplementsSelection(node)
 	} else if c.all {
 		return c.allSelection(node)
 	} else {
-		return 0, 0, errors.New("-line, -offset, -struct or -all is not passed")
+		return 0, 0, errNoSelection
+	}
+}
+
+// process processes the tag of the given field
+func (c *config) process(field fieldInfo, tagVal string) (string, error) {
+	var tag string
+	if tagVal != "" {
+		var err error
+		tag, err = strconv.Unquote(tagVal)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", err, tagVal)
+		}
+	}
+
+	tags, err := structtag.Parse(normalizeTagSpace(tag))
+	if err != nil {
+		// include the original tag, so editors can highlight it
+		return "", fmt.Errorf("%s: %s", err, tagVal)
+	}
+
+	if c.reportMismatches {
+		// only report, leave the tag untouched
+		return tagVal, c.reportMismatch(field, tags)
+	}
+
+	c.splitOptions(tags)
+
+	// the tag in the form it's rendered, i.e: with a single space between
+	// the keys
+	original := c.renderTags(tags)
+
+	tags = c.aliasOptions(tags)
+	tags = c.renameTags(tags)
+	tags = c.removeTags(field, tags)
+	tags = c.removeIgnoredTags(tags)
+	tags = c.keepTags(tags)
+	tags, err = c.removeTagOptions(tags)
+	if err != nil {
+		return "", err
+	}
+
+	tags = c.clearTags(field, tags)
+	tags = c.clearOptions(tags)
+	tags = c.pruneEmptyTags(tags)
+
+	tags, err = c.addTags(field, tags)
+	if err != nil {
+		return "", err
+	}
+
+	tags, err = c.addTagOptions(tags)
+	if err != nil {
+		return "", err
+	}
+
+	tags = c.dedupeOptions(tags)
+
+	if len(field.keyOrder) != 0 {
+		orderTags(tags, field.keyOrder)
+	}
+
+	if c.sort || c.canonical || len(c.sortOrder) != 0 {
+		sort.Sort(tags)
+	}
+
+	if len(c.sortOrder) != 0 {
+		// the keys that aren't part of the order stay sorted after them
+		orderTags(tags, c.sortOrder)
+	}
+
+	if c.canonical {
+		canonicalize(tags)
+	}
+
+	res := c.renderTags(tags)
+
+	if c.minimalDiff {
+		switch {
+		case res == original:
+			// keep the tag as it's written if it's semantically the same,
+			// i.e: if the keys are separated by tabs
+			return tagVal, nil
+		case original == "":
+			// there are no existing keys to keep
+		case strings.HasPrefix(res, original+" "):
+			// only new keys are appended, keep the existing keys as they're
+			// written and append the rendered new keys
+			return quote(strings.TrimSpace(tag) + res[len(original):]), nil
+		case strings.HasSuffix(res, " "+original):
+			// new keys are inserted at the start
+			return quote(res[:len(res)-len(original)] + strings.TrimSpace(tag)), nil
+		}
+	}
+
+	if res != "" {
+		res = quote(res)
+	}
+
+	return res, nil
+}
+
+// splitOptions splits the values of the keys with a custom option separator
+// into the name and the options, i.e: `gorm:"column:name;not null"`. structtag
+// only splits by a comma.
+func (c *config) splitOptions(tags *structtag.Tags) {
+	for key, sep := range c.optionSeparators {
+		t, err := tags.Get(key)
+		if err != nil {
+			continue
+		}
+
+		parts := strings.Split(t.Value(), sep)
+		t.Name = parts[0]
+		t.Options = parts[1:]
+	}
+}
+
+// renderTags returns the tags in the form of `key:"value"` separated by a
+// space, joining the options of the keys with a custom option separator
+// with it. Empty options are kept, i.e: `json:"-,"`, which is the name "-"
+// and not an ignored field.
+func (c *config) renderTags(tags *structtag.Tags) string {
+	var rendered []string
+	for _, t := range tags.Tags() {
+		sep, ok := c.optionSeparators[t.Key]
+		if !ok {
+			sep = ","
+		}
+
+		value := strings.Join(append([]string{t.Name}, t.Options...), sep)
+		rendered = append(rendered, fmt.Sprintf(`%s:%q`, t.Key, value))
+	}
+
+	return strings.Join(rendered, " ")
+}
+
+// normalizeTagSpace replaces the tabs between the keys of a tag with spaces,
+// as structtag only accepts spaces, i.e: `json:"foo"\txml:"foo"`. Quoted
+// values are left untouched.
+func normalizeTagSpace(tag string) string {
+	if !strings.Contains(tag, "\t") {
+		return tag
+	}
+
+	b := []byte(tag)
+	quoted := false
+	for i := 0; i < len(b); i++ {
+		switch {
+		case quoted && b[i] == '\\':
+			i++ // skip the escaped character
+		case b[i] == '"':
+			quoted = !quoted
+		case !quoted && b[i] == '\t':
+			b[i] = ' '
+		}
+	}
+
+	return string(b)
+}
+
+// canonicalize trims the whitespace of tag names and options and sorts the
+// options of each tag, i.e: `json:" foo , string,omitempty"` becomes
+// `json:"foo,omitempty,string"`
+func canonicalize(tags *structtag.Tags) {
+	for _, t := range tags.Tags() {
+		t.Name = strings.TrimSpace(t.Name)
+
+		var options []string
+		for _, opt := range t.Options {
+			opt = strings.TrimSpace(opt)
+			if opt == "" {
+				continue
+			}
+			options = append(options, opt)
+		}
+
+		sort.Strings(options)
+		t.Options = options
+	}
+}
+
+// aliasOptions replaces the spelling of options with their alias, i.e: "not
+// null" becomes "notNull"
+func (c *config) aliasOptions(tags *structtag.Tags) *structtag.Tags {
+	if len(c.optionAliases) == 0 {
+		return tags
+	}
+
+	for _, t := range tags.Tags() {
+		for i, opt := range t.Options {
+			if alias, ok := c.optionAliases[opt]; ok {
+				t.Options[i] = alias
+			}
+		}
+	}
+
+	return tags
+}
+
+func (c *config) removeTags(field fieldInfo, tags *structtag.Tags) *structtag.Tags {
+	if c.remove == nil || len(c.remove) == 0 || (c.embeddedOnly && !field.embedded) {
+		return tags
+	}
+
+	tags.Delete(c.remove...)
+	return tags
+}
+
+// removeIgnoredTags removes the tags of the remove ignored keys whose name is
+// "-", i.e: `json:"-"`. A tag with options, such as `json:"-,"`, isn't
+// ignored but named "-", hence it's kept.
+func (c *config) removeIgnoredTags(tags *structtag.Tags) *structtag.Tags {
+	for _, key := range c.removeIgnored {
+		t, err := tags.Get(key)
+		if err != nil || t.Name != "-" || len(t.Options) != 0 {
+			continue
+		}
+
+		tags.Delete(key)
+	}
+
+	return tags
+}
+
+// renameTags renames the keys of the tags, keeping their names and options.
+// A tag isn't renamed if the tag with the new key exists already. The renames
+// are applied in order, so a:b,b:c renames a tag a to c.
+func (c *config) renameTags(tags *structtag.Tags) *structtag.Tags {
+	if len(c.rename) == 0 {
+		return tags
+	}
+
+	for _, r := range c.rename {
+		tag, err := tags.Get(r.from)
+		if err != nil {
+			continue
+		}
+
+		if _, err := tags.Get(r.to); err == nil {
+			continue
+		}
+
+		// the tag is renamed in place, hence it keeps its position
+		tag.Key = r.to
+	}
+
+	return tags
+}
+
+// keepTags removes all tags except the ones with the keys to be kept
+func (c *config) keepTags(tags *structtag.Tags) *structtag.Tags {
+	if len(c.keep) == 0 {
+		return tags
+	}
+
+	var remove []string
+	for _, key := range tags.Keys() {
+		keep := false
+		for _, k := range c.keep {
+			if key == k {
+				keep = true
+				break
+			}
+		}
+
+		if !keep {
+			remove = append(remove, key)
+		}
+	}
+
+	tags.Delete(remove...)
+	return tags
+}
+
+func (c *config) clearTags(field fieldInfo, tags *structtag.Tags) *structtag.Tags {
+	if (!c.clear && len(c.clearKeys) == 0) || (c.embeddedOnly && !field.embedded) {
+		return tags
+	}
+
+	if !c.clear {
+		tags.Delete(c.clearKeys...)
+		return tags
+	}
+
+	tags.Delete(tags.Keys()...)
+	return tags
+}
+
+func (c *config) clearOptions(tags *structtag.Tags) *structtag.Tags {
+	if !c.clearOption {
+		return tags
+	}
+
+	for _, t := range tags.Tags() {
+		t.Options = nil
+	}
+
+	return tags
+}
+
+// pruneEmptyTags removes the tags without a name and options, i.e: `json:""`
+// after removing the only option of `json:",omitempty"`
+func (c *config) pruneEmptyTags(tags *structtag.Tags) *structtag.Tags {
+	if !c.pruneEmpty {
+		return tags
+	}
+
+	var empty []string
+	for _, t := range tags.Tags() {
+		if t.Name == "" && len(t.Options) == 0 {
+			empty = append(empty, t.Key)
+		}
+	}
+
+	tags.Delete(empty...)
+	return tags
+}
+
+// dedupeOptions removes the repeated options of each tag, keeping the first
+// one, i.e: `json:"foo,omitempty,omitempty"` becomes `json:"foo,omitempty"`
+func (c *config) dedupeOptions(tags *structtag.Tags) *structtag.Tags {
+	if !c.dedupe {
+		return tags
+	}
+
+	for _, t := range tags.Tags() {
+		seen := make(map[string]bool, len(t.Options))
+		options := t.Options[:0]
+		for _, opt := range t.Options {
+			if seen[opt] {
+				continue
+			}
+			seen[opt] = true
+			options = append(options, opt)
+		}
+		t.Options = options
+	}
+
+	return tags
+}
+
+func (c *config) removeTagOptions(tags *structtag.Tags) (*structtag.Tags, error) {
+	if c.removeOptions == nil || len(c.removeOptions) == 0 {
+		return tags, nil
+	}
+
+	for _, val := range c.removeOptions {
+		// syntax key=option
+		splitted := strings.Split(val, "=")
+		if len(splitted) < 2 {
+			return nil, errors.New("wrong syntax to remove an option. i.e key=option")
+		}
+
+		key := splitted[0]
+		option := strings.Join(splitted[1:], "=")
+
+		if c.removeOptionIfLast {
+			tag, err := tags.Get(key)
+			if err != nil || len(tag.Options) != 1 || tag.Options[0] != option {
+				continue
+			}
+		}
+
+		tags.DeleteOptions(key, option)
+	}
+
+	return tags, nil
+}
+
+func (c *config) addTagOptions(tags *structtag.Tags) (*structtag.Tags, error) {
+	if c.addOptions == nil || len(c.addOptions) == 0 {
+		return tags, nil
+	}
+
+	for _, val := range c.addOptions {
+		// syntax key=option
+		splitted := strings.Split(val, "=")
+		if len(splitted) < 2 {
+			return nil, errors.New("wrong syntax to add an option. i.e key=option")
+		}
+
+		key := splitted[0]
+		option := strings.Join(splitted[1:], "=")
+
+		if _, err := tags.Get(key); err != nil && c.createOptionTags {
+			// i.e: json:",omitempty", the name is left to the default
+			if err := tags.Set(&structtag.Tag{Key: key, Options: []string{option}}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		tags.AddOptions(key, option)
+	}
+
+	return tags, nil
+}
+
+func (c *config) addTags(field fieldInfo, tags *structtag.Tags) (*structtag.Tags, error) {
+	if c.add == nil || len(c.add) == 0 {
+		return tags, nil
+	}
+
+	fieldName, ok, err := c.deriveName(field)
+	if err != nil {
+		return nil, err
+	}
+	unknown := !ok
+
+	// inserted is the number of new tags moved to the beginning
+	inserted := 0
+	for _, key := range c.add {
+		var name string
+		splitted := strings.SplitN(key, ":", 2)
+		if len(splitted) >= 2 {
+			key = splitted[0]
+			name = strings.Join(splitted[1:], "")
+		} else if inherited := field.inheritedName(key); inherited != "" {
+			name = inherited
+		} else if unknown {
+			// the user didn't pass any value but want to use an unknown
+			// transform. We don't return above in the default as the user
+			// might pass a value
+			return nil, fmt.Errorf("unknown transform option %q", c.fieldTransform(field))
+		} else if name, err = c.formatName(key, fieldName, field); err != nil {
+			return nil, err
+		} else if format, _ := c.keyFormat(key, field); name == "" && format != "" && fieldName != "" {
+			// i.e: {doc} of a field without a doc comment
+			return nil, fmt.Errorf("field %s results in an empty %s tag name with the template %q",
+				field.name, key, format)
+		} else if name == "" {
+			// i.e: the field "_" with the snakecase transform
+			return nil, fmt.Errorf("field %s results in an empty %s tag name with the %s transform",
+				field.name, key, c.fieldTransform(field))
+		}
+		c.explainName(field, key, name, len(splitted) >= 2)
+
+		tag, err := tags.Get(key)
+		isNew := err != nil
+		if isNew {
+			// tag doesn't exist, create a new one
+			tag = &structtag.Tag{
+				Key:  key,
+				Name: name,
+			}
+		} else if c.override {
+			tag.Name = name
+		}
+
+		if err := tags.Set(tag); err != nil {
+			return nil, err
+		}
+
+		// Set() appends new tags, move them in front of the existing ones
+		// while keeping the order of the given keys
+		if isNew && c.insertPosition == "start" {
+			for i := tags.Len() - 1; i > inserted; i-- {
+				tags.Swap(i, i-1)
+			}
+			inserted++
+		}
+	}
+
+	return tags, nil
+}
+
+// reportMismatch returns an error if the name of an existing tag for the keys
+// to be added doesn't match the name derived from the field name.
+func (c *config) reportMismatch(field fieldInfo, tags *structtag.Tags) error {
+	name, ok, err := c.deriveName(field)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, key := range c.add {
+		var want string
+		splitted := strings.SplitN(key, ":", 2)
+		if len(splitted) >= 2 {
+			key = splitted[0]
+			want = splitted[1]
+		} else if !ok {
+			return fmt.Errorf("unknown transform option %q", c.fieldTransform(field))
+		} else if want, err = c.formatName(key, name, field); err != nil {
+			return err
+		}
+
+		tag, err := tags.Get(key)
+		if err != nil || tag.Name == "" || tag.Name == "-" {
+			continue
+		}
+
+		if tag.Name != want {
+			mismatches = append(mismatches,
+				fmt.Sprintf("%s tag name %q doesn't match %q", key, tag.Name, want))
+		}
+	}
+
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("field %s: %s", field.name, strings.Join(mismatches, ", "))
+}
+
+// deriveName derives the name of the given field by transforming it or by
+// running the name command. It returns false if the transform is unknown.
+func (c *config) deriveName(field fieldInfo) (string, bool, error) {
+	name, ok := "", true
+	if c.nameCommand != "" {
+		var err error
+		name, err = c.runNameCommand(field)
+		if err != nil {
+			return "", false, err
+		}
+	} else {
+		base := field.name
+		if field.baseName != "" {
+			base = field.baseName
+		}
+		name, ok = c.transformName(c.fieldTransform(field), base)
+	}
+
+	if c.allowedChars != nil {
+		name = sanitizeName(name, c.allowedChars)
+	}
+
+	return name, ok, nil
+}
+
+// sanitizeName replaces the characters of name that don't match allowed with
+// an underscore, i.e: "größe" becomes "gr__e" for [a-z0-9_]
+func sanitizeName(name string, allowed *regexp.Regexp) string {
+	var buf strings.Builder
+	for _, r := range name {
+		if allowed.MatchString(string(r)) {
+			buf.WriteRune(r)
+		} else {
+			buf.WriteByte('_')
+		}
+	}
+
+	return buf.String()
+}
+
+// fieldTransform returns the transform of the given field
+func (c *config) fieldTransform(field fieldInfo) string {
+	if field.transform != "" {
+		return field.transform
+	}
+	return c.transform
+}
+
+// formatName applies the value format of the given key to the derived name
+// of a field.
+func (c *config) formatName(key, name string, field fieldInfo) (string, error) {
+	format, _ := c.keyFormat(key, field)
+	if format == "" {
+		return name, nil
+	}
+
+	return c.formatValue(format, name, field)
+}
+
+// keyFormat returns the value format of the given key and field, along with
+// the flag it's set by. The format is empty if the name isn't formatted.
+func (c *config) keyFormat(key string, field fieldInfo) (string, string) {
+	// gojson mirrors the default key of encoding/json, hence the name is
+	// never formatted
+	if c.fieldTransform(field) == "gojson" {
+		return "", ""
+	}
+
+	if field.embedded && c.valueFormatEmbedded != "" {
+		return c.valueFormatEmbedded, "-template-embedded"
+	}
+
+	if f, ok := c.valueFormatByKey[key]; ok {
+		return f, "-template-by-key"
+	}
+
+	if c.valueFormat != "" {
+		return c.valueFormat, "-template"
+	}
+
+	return "", ""
+}
+
+// explainName writes the rules the tag name of the given key and field is
+// derived by, i.e: "foo.FieldName: json:\"field_name\" by transform snakecase"
+func (c *config) explainName(field fieldInfo, key, name string, explicit bool) {
+	if c.explain == nil {
+		return
+	}
+
+	inherited := !explicit && field.inheritedName(key) != ""
+
+	var rules []string
+	switch {
+	case explicit:
+		rules = append(rules, "explicit value")
+	case inherited:
+		rules = append(rules, "inheritance from an embedded struct")
+	case c.nameCommand != "":
+		rules = append(rules, fmt.Sprintf("name command %q", c.nameCommand))
+	case field.transform != "":
+		rules = append(rules, fmt.Sprintf("transform %s (inferred)", field.transform))
+	default:
+		rules = append(rules, fmt.Sprintf("transform %s", c.transform))
+	}
+
+	if !explicit && !inherited {
+		if field.baseName != "" && c.nameCommand == "" {
+			rules = append(rules, fmt.Sprintf("comment name:%s", field.baseName))
+		}
+
+		if c.allowedChars != nil {
+			rules = append(rules, fmt.Sprintf("-allowed-chars %q", c.allowedChars))
+		}
+
+		if format, flagName := c.keyFormat(key, field); format != "" {
+			rules = append(rules, fmt.Sprintf("%s %q", flagName, format))
+		}
+	}
+
+	fieldName := field.name
+	if field.structName != "" {
+		fieldName = field.structName + "." + fieldName
+	}
+
+	fmt.Fprintf(c.explain, "%s: %s:%q by %s\n", fieldName, key, name, strings.Join(rules, ", "))
+}
+
+// runNameCommand returns the name of the given field from the output of the
+// name command, which is used instead of a transform. The command reads the
+// struct and the field name from its standard input, each on a separate line.
+func (c *config) runNameCommand(field fieldInfo) (string, error) {
+	args := strings.Fields(c.nameCommand)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(field.structName + "\n" + field.name + "\n")
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("name command failed for field %s: %s %s",
+			field.name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	name := strings.TrimSpace(string(out))
+	if name == "" {
+		return "", fmt.Errorf("name command returned an empty name for field %s", field.name)
+	}
+
+	return name, nil
+}
+
+// transformName transforms the given field name according to the given
+// transform option. It returns false if the transform is unknown.
+func (c *config) transformName(transform, fieldName string) (string, bool) {
+	splitted := splitName(fieldName, c.initialisms)
+	name := ""
+
+	switch transform {
+	case "snakecase":
+		name = snakeCase(splitted, c.preserveUnderscores)
+	case "screamingsnake":
+		name = strings.ToUpper(snakeCase(splitted, c.preserveUnderscores))
+	case "lispcase":
+		var lowerSplitted []string
+		for _, s := range splitted {
+			lowerSplitted = append(lowerSplitted, strings.ToLower(s))
+		}
+
+		name = strings.Join(lowerSplitted, "-")
+	case "camelcase":
+		var titled []string
+		for _, s := range splitted {
+			titled = append(titled, titleWord(s))
+		}
+
+		titled[0] = strings.ToLower(titled[0])
+
+		name = strings.Join(titled, "")
+	case "pascalcase":
+		var titled []string
+		for _, s := range splitted {
+			titled = append(titled, titleWord(s))
+		}
+
+		name = strings.Join(titled, "")
+	case "titlecase":
+		var titled []string
+		for _, s := range splitted {
+			titled = append(titled, titleWord(s))
+		}
+
+		name = strings.Join(titled, " ")
+	case "keep", "gojson":
+		name = fieldName
+	default:
+		return "", false
+	}
+
+	return name, true
+}
+
+// titleWord returns the word with its first letter in title case, the rest
+// of the word is kept as is. Unlike strings.Title, the letters following
+// digits or other characters aren't modified.
+func titleWord(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 {
+		return s
+	}
+
+	return string(unicode.ToTitle(r)) + s[size:]
+}
+
+// splitName splits the given field name into words. Known initialisms are
+// kept as a single word, even if they're adjacent to other upper case letters
+// or followed by a plural "s", i.e: "UserIDs" -> "User", "IDs" or "HTTPAPI" ->
+// "HTTP", "API". The remaining parts are split by their case.
+func splitName(name string, initialisms []string) []string {
+	if len(initialisms) == 0 {
+		return camelcase.Split(name)
+	}
+
+	var words []string
+	start := 0 // start of the part that is not an initialism
+	for i := 0; i < len(name); i++ {
+		// an initialism can only start after a word, i.e: "ID" is not
+		// matched inside "UUID"
+		if i != start && isUpper(name[i-1]) {
+			continue
+		}
+
+		word := matchInitialism(name[i:], initialisms)
+		if word == "" {
+			continue
+		}
+
+		if start < i {
+			words = append(words, camelcase.Split(name[start:i])...)
+		}
+		words = append(words, word)
+
+		i += len(word) - 1
+		start = i + 1
+	}
+
+	if start < len(name) {
+		words = append(words, camelcase.Split(name[start:])...)
+	}
+
+	return words
+}
+
+// matchInitialism returns the longest initialism the given string starts
+// with, including a plural "s". The initialism has to end at a word boundary,
+// i.e: "ID" matches "IDToken", but not "IDEConfig".
+func matchInitialism(s string, initialisms []string) string {
+	var match string
+	for _, in := range initialisms {
+		if in == "" || len(in) <= len(match) || !strings.HasPrefix(s, in) {
+			continue
+		}
+
+		rest := s[len(in):]
+		if rest == "s" || strings.HasPrefix(rest, "s") && !isLower(rest[1]) {
+			// plural, i.e: "IDs"
+			match = in + "s"
+			continue
+		}
+
+		switch {
+		case rest == "",
+			!isUpper(rest[0]),
+			len(rest) > 1 && isLower(rest[1]),
+			matchInitialism(rest, initialisms) != "":
+			match = in
+		}
+	}
+
+	return match
+}
+
+func isUpper(b byte) bool { return 'A' <= b && b <= 'Z' }
+
+func isLower(b byte) bool { return 'a' <= b && b <= 'z' }
+
+// snakeCase lower cases the given words and joins them with an underscore.
+// Underscores of the field name itself (leading, trailing or repeated ones)
+// are dropped, unless preserveUnderscores is set.
+func snakeCase(words []string, preserveUnderscores bool) string {
+	var buf strings.Builder
+	sep := false
+	for _, s := range words {
+		if strings.Trim(s, "_") == "" {
+			if preserveUnderscores {
+				// the underscores are already a separator
+				buf.WriteString(s)
+				sep = false
+			}
+			continue
+		}
+
+		if sep {
+			buf.WriteString("_")
+		}
+		buf.WriteString(strings.ToLower(s))
+		sep = true
+	}
+
+	return buf.String()
+}
+
+// placeholders returns the placeholders of a value format followed by their
+// value for the given field, as expected by strings.NewReplacer. The
+// {env:NAME} placeholder is expanded separately.
+func placeholders(name, structName string, field fieldInfo) []string {
+	return []string{
+		"{field}", name,
+		"{struct}", structName,
+		"{index}", strconv.Itoa(field.index),
+		"{doc}", field.doc,
+	}
+}
+
+// fieldDoc returns the first line of the doc comment of the given field, to
+// be used inside a tag value, i.e: "The user name" for "// The user name".
+// Backticks can't be part of a tag and are replaced by single quotes.
+func fieldDoc(f *ast.Field) string {
+	if f.Doc == nil {
+		return ""
+	}
+
+	doc := strings.TrimSpace(f.Doc.Text())
+	if i := strings.IndexByte(doc, '\n'); i != -1 {
+		doc = doc[:i]
+	}
+
+	doc = strings.ReplaceAll(doc, "`", "'")
+	return strings.Join(strings.Fields(doc), " ")
+}
+
+// commentName returns the name of a "//name:Ident" comment of the given
+// field, either above or next to it. The name is transformed instead of the
+// field name, i.e: "//name:UserKey" results in json:"user_key" with
+// snakecase. "// name:Ident" with a single space is accepted as well, but only
+// with a valid Go identifier right after "name:", so prose such as
+// "// name: the full name" is ignored.
+func commentName(f *ast.Field) string {
+	for _, cg := range []*ast.CommentGroup{f.Doc, f.Comment} {
+		if cg == nil {
+			continue
+		}
+
+		// the Text() of a comment group drops directives such as
+		// "//name:Ident", hence the comments are parsed one by one
+		for _, c := range cg.List {
+			// a single space is allowed, i.e: "// name:Ident"
+			text := strings.TrimPrefix(strings.TrimPrefix(c.Text, "//"), " ")
+			if !strings.HasPrefix(text, "name:") {
+				continue
+			}
+
+			if name := text[len("name:"):]; token.IsIdentifier(name) {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+// envPlaceholder matches the {env:NAME} placeholder of a value format
+var envPlaceholder = regexp.MustCompile(`\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// formatValue expands the placeholders inside the given format with the
+// transformed field name. {struct} is replaced with the name of the enclosing
+// struct, transformed the same way as the field name. {index} is replaced with
+// the 1-based position of the field inside its struct, i.e: to number protobuf
+// fields, and {doc} with the first line of its doc comment. The {env:NAME}
+// placeholder is replaced with the value of the environment variable NAME,
+// unless it's disabled. An unset environment variable is an error, an empty
+// one expands to an empty string.
+func (c *config) formatValue(format, name string, field fieldInfo) (string, error) {
+	if !strings.Contains(format, "{field}") {
+		// support old style for backward compatibility
+		format = strings.ReplaceAll(format, "$field", "{field}")
+	}
+
+	// anonymous structs and unknown transforms result in an empty name
+	structName := ""
+	if field.structName != "" {
+		structName, _ = c.transformName(c.fieldTransform(field), field.structName)
+	}
+
+	// the environment variables of the format are looked up before the
+	// replacement, so the substituted values, i.e: a doc comment, can't refer
+	// to one
+	replacements := placeholders(name, structName, field)
+	if !c.disableEnv {
+		for _, m := range envPlaceholder.FindAllStringSubmatch(format, -1) {
+			env, ok := os.LookupEnv(m[1])
+			if !ok {
+				return "", fmt.Errorf("environment variable %q is not set", m[1])
+			}
+			replacements = append(replacements, m[0], env)
+		}
+	}
+
+	return strings.NewReplacer(replacements...).Replace(format), nil
+}
+
+// collectStructs collects and maps structType nodes to their positions
+func collectStructs(node ast.Node) map[token.Pos]*structType {
+	structs := make(map[token.Pos]*structType, 0)
+
+	// the doc comment of a single type declaration belongs to the *ast.GenDecl
+	genDeclDocs := make(map[*ast.TypeSpec]*ast.CommentGroup)
+
+	collectStructs := func(n ast.Node) bool {
+		var t ast.Expr
+		var structName string
+		var doc *ast.CommentGroup
+
+		switch x := n.(type) {
+		case *ast.GenDecl:
+			for _, spec := range x.Specs {
+				if ts, ok := spec.(*ast.TypeSpec); ok && ts.Doc == nil {
+					genDeclDocs[ts] = x.Doc
+				}
+			}
+		case *ast.TypeSpec:
+			if x.Type == nil {
+				return true
+
+			}
+
+			structName = x.Name.Name
+			t = x.Type
+			doc = x.Doc
+			if doc == nil {
+				doc = genDeclDocs[x]
+			}
+		case *ast.CompositeLit:
+			t = x.Type
+		case *ast.ValueSpec:
+			structName = x.Names[0].Name
+			t = x.Type
+		case *ast.Field:
+			// this case also catches struct fields and the structName
+			// therefore might contain the field name (which is wrong)
+			// because `x.Type` in this case is not a *ast.StructType.
+			//
+			// We're OK with it, because, in our case *ast.Field represents
+			// a parameter declaration, i.e:
+			//
+			//   func test(arg struct {
+			//   	Field int
+			//   }) {
+			//   }
+			//
+			// and hence the struct name will be `arg`.
+			if len(x.Names) != 0 {
+				structName = x.Names[0].Name
+			}
+			t = x.Type
+		}
+
+		// if expression is in form "*T" or "[]T", dereference to check if "T"
+		// contains a struct expression
+		t = deref(t)
+
+		x, ok := t.(*ast.StructType)
+		if !ok {
+			return true
+		}
+
+		structs[x.Pos()] = &structType{
+			name: structName,
+			node: x,
+			doc:  doc,
+		}
+		return true
+	}
+
+	ast.Inspect(node, collectStructs)
+	return structs
+}
+
+// collectInterfaces collects the names of the interface types declared in
+// the given node
+func collectInterfaces(node ast.Node) map[string]bool {
+	interfaces := make(map[string]bool)
+	ast.Inspect(node, func(n ast.Node) bool {
+		ts, ok := n.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+
+		if _, ok := ts.Type.(*ast.InterfaceType); ok {
+			interfaces[ts.Name.Name] = true
+		}
+		return true
+	})
+
+	return interfaces
+}
+
+// collectImports collects the import paths of the given node, mapped to the
+// name they're imported with. The name is empty if the package name is used.
+func collectImports(node ast.Node) map[string]string {
+	imports := make(map[string]string)
+	ast.Inspect(node, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ImportSpec)
+		if !ok {
+			return true
+		}
+
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return true
+		}
+
+		imports[path] = ""
+		if spec.Name != nil {
+			imports[path] = spec.Name.Name
+		}
+		return true
+	})
+
+	return imports
+}
+
+// isInterface reports whether the given type is an interface. Besides
+// interface literals, the predeclared and the given interfaces are known.
+// Interfaces of other packages, i.e: http.Handler, are resolved from the
+// imports.
+func (c *config) isInterface(t ast.Expr, interfaces map[string]bool, imports map[string]string) bool {
+	switch x := t.(type) {
+	case *ast.InterfaceType:
+		return true
+	case *ast.Ident:
+		return x.Name == "error" || x.Name == "any" || interfaces[x.Name]
+	case *ast.ParenExpr:
+		return c.isInterface(x.X, interfaces, imports)
+	case *ast.SelectorExpr:
+		pkg, ok := x.X.(*ast.Ident)
+		if !ok {
+			return false
+		}
+		return c.importedInterface(pkg.Name, x.Sel.Name, imports)
+	}
+	return false
+}
+
+// importedInterface reports whether the given type of the package imported
+// as pkgName is an interface. The imported packages are type checked from
+// source, relative to the directory of the file. A package that can't be
+// loaded is assumed not to be an interface.
+func (c *config) importedInterface(pkgName, typeName string, imports map[string]string) bool {
+	if c.importer == nil {
+		c.importer = newPackageImporter()
+	}
+
+	// try the paths whose last element matches the name first, the others
+	// are only loaded if there is no match, i.e: for gopkg.in/yaml.v3
+	paths := make([]string, 0, len(imports))
+	for path := range imports {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		mi, mj := filepath.Base(paths[i]) == pkgName, filepath.Base(paths[j]) == pkgName
+		if mi != mj {
+			return mi
+		}
+		return paths[i] < paths[j]
+	})
+
+	for _, path := range paths {
+		name := imports[path]
+		if name != "" && name != pkgName {
+			continue
+		}
+
+		pkg := c.importer.importPackage(path, filepath.Dir(c.file))
+		if pkg == nil || (name == "" && pkg.Name() != pkgName) {
+			continue
+		}
+
+		obj, ok := pkg.Scope().Lookup(typeName).(*types.TypeName)
+		return ok && types.IsInterface(obj.Type())
+	}
+
+	return false
+}
+
+// packageImporter type checks imported packages from source. The packages
+// are cached, so each package is only type checked once, even if it's
+// imported by multiple files.
+type packageImporter struct {
+	importer types.ImporterFrom
+
+	// packages maps the directory and the import path of a package to the
+	// package, nil if it can't be loaded
+	packages map[[2]string]*types.Package
+}
+
+func newPackageImporter() *packageImporter {
+	p := &packageImporter{packages: make(map[[2]string]*types.Package)}
+	if imp, ok := importer.ForCompiler(token.NewFileSet(), "source", nil).(types.ImporterFrom); ok {
+		p.importer = imp
+	}
+	return p
+}
+
+// importPackage returns the package of the given import path, imported from
+// the given directory. It returns nil if the package can't be loaded.
+func (p *packageImporter) importPackage(path, dir string) *types.Package {
+	key := [2]string{dir, path}
+	if pkg, ok := p.packages[key]; ok {
+		return pkg
+	}
+
+	var pkg *types.Package
+	if p.importer != nil {
+		if imported, err := p.importer.ImportFrom(path, dir, 0); err == nil {
+			pkg = imported
+		}
+	}
+
+	p.packages[key] = pkg
+	return pkg
+}
+
+// inheritedName returns the name of the given key of the inherited tags, if
+// the key has a name
+func (f fieldInfo) inheritedName(key string) string {
+	if f.inherited == nil {
+		return ""
+	}
+
+	tag, err := f.inherited.Get(key)
+	if err != nil || tag.Name == "-" {
+		return ""
+	}
+	return tag.Name
+}
+
+// embeddedTags returns the tags of the fields promoted by the structs embedded
+// in st, by field name. Only the structs declared in the same file are
+// resolved, the fields of the outer embedded structs win like in Go.
+func embeddedTags(st *ast.StructType, structs map[token.Pos]*structType) map[string]*structtag.Tags {
+	named := make(map[string]*ast.StructType)
+	for _, s := range structs {
+		if s.name != "" {
+			named[s.name] = s.node
+		}
+	}
+
+	tags := make(map[string]*structtag.Tags)
+	visited := map[*ast.StructType]bool{st: true}
+
+	// the embedded structs are resolved level by level
+	level := []*ast.StructType{st}
+	for len(level) != 0 {
+		var next []*ast.StructType
+		for _, s := range level {
+			for _, f := range s.Fields.List {
+				if f.Names != nil {
+					continue
+				}
+
+				typ := f.Type
+				if star, ok := typ.(*ast.StarExpr); ok {
+					typ = star.X
+				}
+
+				ident, ok := typ.(*ast.Ident)
+				if !ok || named[ident.Name] == nil || visited[named[ident.Name]] {
+					continue
+				}
+				visited[named[ident.Name]] = true
+				next = append(next, named[ident.Name])
+			}
+		}
+
+		for _, base := range next {
+			for _, f := range base.Fields.List {
+				if f.Tag == nil {
+					continue
+				}
+
+				t, err := structtag.Parse(unquoteTag(f.Tag.Value))
+				if err != nil {
+					continue
+				}
+
+				for _, n := range f.Names {
+					if _, ok := tags[n.Name]; !ok {
+						tags[n.Name] = t
+					}
+				}
+			}
+		}
+
+		level = next
+	}
+
+	return tags
+}
+
+func (c *config) format(file ast.Node, rwErrs error) (string, error) {
+	switch c.output {
+	case "source", "diff":
+		out, err := c.formatSource(file)
+		if err != nil {
+			return "", err
+		}
+
+		if c.stamp && len(c.edits) != 0 {
+			out = c.addStamp(out)
+		}
+
+		if c.write && (!c.inDir || len(c.edits) != 0) && (rwErrs == nil || !c.noWriteOnError) {
+			data := out
+			if c.bom {
+				data = append(append([]byte{}, utf8BOM...), out...)
+			}
+
+			err = writeFile(c.file, data)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if c.output == "diff" {
+			return c.unifiedDiff(out), nil
+		}
+
+		return string(out), nil
+	case "text-edits":
+		o, err := json.MarshalIndent(c.edits, "", "  ")
+		if err != nil {
+			return "", err
+		}
+
+		return string(o), nil
+	case "json":
+		lines, err := c.sourceLines(file)
+		if err != nil {
+			return "", err
+		}
+
+		// prevent selection to be larger than the actual number of lines
+		if c.start > len(lines) || c.end > len(lines) {
+			return "", errors.New("line selection is invalid")
+		}
+
+		out := &output{
+			Start: c.start,
+			End:   c.end,
+			Lines: lines[c.start-1 : c.end],
+		}
+
+		for _, sc := range c.structChanges {
+			out.Modified = append(out.Modified, sc.modified...)
+		}
+
+		if rwErrs != nil {
+			if r, ok := rwErrs.(*rewriteErrors); ok {
+				for _, err := range r.errs {
+					out.Errors = append(out.Errors, err.Error())
+				}
+			}
+		}
+
+		o, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return "", err
+		}
+
+		return string(o), nil
+	case "json-per-struct":
+		lines, err := c.sourceLines(file)
+		if err != nil {
+			return "", err
+		}
+
+		outs := make([]*output, 0, len(c.structChanges))
+		for _, sc := range c.structChanges {
+			if sc.end > len(lines) {
+				return "", errors.New("line selection is invalid")
+			}
+
+			outs = append(outs, &output{
+				Start:    sc.start,
+				End:      sc.end,
+				Lines:    lines[sc.start-1 : sc.end],
+				Errors:   sc.errs,
+				Modified: sc.modified,
+			})
+		}
+
+		o, err := json.MarshalIndent(outs, "", "  ")
+		if err != nil {
+			return "", err
+		}
+
+		return string(o), nil
+	case "yaml":
+		return mappingYAML(c.mapping), nil
+	default:
+		return "", fmt.Errorf("unknown output mode: %s", c.output)
+	}
+}
+
+// formatSource returns the source of the given file. A partial AST of a file
+// with syntax errors can't be printed, instead the edits are applied to the
+// original source.
+func (c *config) formatSource(file ast.Node) ([]byte, error) {
+	if len(c.parseErrors) != 0 {
+		return applyEdits(c.src, c.edits), nil
+	}
+
+	var buf bytes.Buffer
+	err := format.Node(&buf, c.fset, file)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.fragment {
+		out := bytes.TrimPrefix(buf.Bytes(), []byte(fragmentHeader))
+		return bytes.TrimLeft(out, "\n"), nil
+	}
+
+	return buf.Bytes(), nil
+}
+
+// applyEdits applies the given non-overlapping edits to src
+func applyEdits(src []byte, edits []textEdit) []byte {
+	sorted := make([]textEdit, len(edits))
+	copy(sorted, edits)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].start < sorted[j].start
+	})
+
+	var out []byte
+	last := 0
+	for _, e := range sorted {
+		out = append(out, src[last:e.start]...)
+		out = append(out, e.NewText...)
+		last = e.end
+	}
+
+	return append(out, src[last:]...)
+}
+
+// sourceLines prints the given file and returns its lines, positioned as in
+// the original source.
+func (c *config) sourceLines(file ast.Node) ([]string, error) {
+	if len(c.parseErrors) != 0 {
+		return parseLines(bytes.NewReader(applyEdits(c.src, c.edits)))
+	}
+
+	// NOTE(arslan): print first the whole file and then cut out our
+	// selection. The reason we don't directly print the struct is that the
+	// printer is not capable of printing loosy comments, comments that are
+	// not part of any field inside a struct. Those are part of *ast.File
+	// and only printed inside a struct if we print the whole file. This
+	// approach is the sanest and simplest way to get a struct printed
+	// back. Second, our cursor might intersect two different structs with
+	// other declarations in between them. Printing the file and cutting
+	// the selection is the easier and simpler to do.
+	var buf bytes.Buffer
+
+	// this is the default config from `format.Node()`, but we add
+	// `printer.SourcePos` to get the original source position of the
+	// modified lines
+	cfg := printer.Config{Mode: printer.SourcePos | printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	err := cfg.Fprint(&buf, c.fset, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLines(&buf)
+}
+
+// stampPrefix is the prefix of the comment added with -stamp
+const stampPrefix = "// tags updated by gomodifytags on "
+
+// addStamp adds a comment with the current date to the given source. The
+// stamp is placed above the package comment, after the leading comments such
+// as license headers and build constraints. An existing stamp is updated
+// instead, so it's never duplicated. The stamp is separated with an empty
+// line, so it's not a package comment.
+func (c *config) addStamp(src []byte) []byte {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+
+	stamp := stampPrefix + now().Format("2006-01-02")
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments|parser.PackageClauseOnly)
+	if err != nil {
+		// i.e: a fragment without a package clause
+		return append([]byte(stamp+"\n\n"), src...)
+	}
+
+	pos := f.Package
+	if f.Doc != nil {
+		pos = f.Doc.Pos()
+	}
+
+	for _, cg := range f.Comments {
+		if cg.Pos() >= pos {
+			break
+		}
+
+		for _, cm := range cg.List {
+			if strings.HasPrefix(cm.Text, stampPrefix) {
+				start, end := fset.Position(cm.Pos()).Offset, fset.Position(cm.End()).Offset
+				return append(append(append([]byte{}, src[:start]...), stamp...), src[end:]...)
+			}
+		}
+	}
+
+	offset := fset.Position(pos).Offset
+	return append(append(append([]byte{}, src[:offset]...), stamp+"\n\n"...), src[offset:]...)
+}
+
+// writeFile replaces the content of the given file atomically. The data is
+// written to a temporary file in the same directory, which is then renamed to
+// the given file, so a crash never leaves a truncated file behind. The
+// permissions of the original file are preserved, a file that doesn't exist
+// is created with 0644. A symlink is followed, so the file it points to is
+// replaced instead of the link.
+func writeFile(filename string, data []byte) (err error) {
+	if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = resolved
+	}
+
+	mode := os.FileMode(0644)
+	fi, err := os.Stat(filename)
+	if err == nil {
+		mode = fi.Mode()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".gomodifytags")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = f.Chmod(mode); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+// lineSelection selects the fields of the given line or range of lines, i.e:
+// 4 or 4,6. Multiple ranges are separated by a semicolon, i.e: 4,6;10,12, and
+// are modified in a single pass.
+func (c *config) lineSelection(file ast.Node) (int, int, error) {
+	var ranges []lineRange
+	for _, l := range strings.Split(c.line, ";") {
+		start, end, err := parseLineRange(strings.TrimSpace(l))
+		if err != nil {
+			return 0, 0, err
+		}
+
+		ranges = append(ranges, lineRange{start: start, end: end})
+	}
+
+	if len(ranges) == 1 {
+		return ranges[0].start, ranges[0].end, nil
+	}
+
+	return c.selectRanges(ranges)
+}
+
+// parseLineRange parses a line or a range of lines, i.e: 4 or 4,6
+func parseLineRange(s string) (int, int, error) {
+	var err error
+	splitted := strings.Split(s, ",")
+
+	start, err := strconv.Atoi(splitted[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end := start
+	if len(splitted) == 2 {
+		end, err = strconv.Atoi(splitted[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if start > end {
+		return 0, 0, errors.New("wrong range. start line cannot be larger than end line")
+	}
+
+	return start, end, nil
+}
+
+// linesSelection selects the fields on the given comma separated list of
+// lines, i.e: 4,7,9
+func (c *config) linesSelection(file ast.Node) (int, int, error) {
+	var ranges []lineRange
+	for _, l := range strings.Split(c.lines, ",") {
+		line, err := strconv.Atoi(strings.TrimSpace(l))
+		if err != nil {
+			return 0, 0, err
+		}
+
+		ranges = append(ranges, lineRange{start: line, end: line})
+	}
+
+	return c.selectRanges(ranges)
+}
+
+func (c *config) structSelection(file ast.Node) (int, int, error) {
+	return c.structFieldSelection(file, c.structName, c.fieldName)
+}
+
+// structFieldSelection selects the given struct, or only the given field of
+// it if fieldName is not empty
+func (c *config) structFieldSelection(file ast.Node, structName, fieldName string) (int, int, error) {
+	structs := collectStructs(file)
+
+	// structs with the same name in different scopes, in source order
+	var matches []*ast.StructType
+	for _, st := range structs {
+		if st.name == structName {
+			matches = append(matches, st.node)
+		}
+	}
+
+	if len(matches) == 0 {
+		return 0, 0, errors.New("struct name does not exist")
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Pos() < matches[j].Pos()
+	})
+
+	// by default the last one is selected
+	encStruct := matches[len(matches)-1]
+	if c.occurrence != 0 {
+		if c.occurrence > len(matches) {
+			return 0, 0, fmt.Errorf("struct %q has %d occurrences, can't select occurrence %d",
+				structName, len(matches), c.occurrence)
+		}
+		encStruct = matches[c.occurrence-1]
+	}
+
+	// if field name has been specified as well, only select the given field
+	if fieldName != "" {
+		return c.fieldSelection(encStruct, structName, fieldName)
+	}
+
+	start := c.fset.Position(encStruct.Pos()).Line
+	end := c.fset.Position(encStruct.End()).Line
+
+	return start, end, nil
+}
+
+// structCommentSelection selects all structs whose doc comment contains the
+// given marker, i.e: "@entity"
+func (c *config) structCommentSelection(file ast.Node) (int, int, error) {
+	structs := collectStructs(file)
+
+	var ranges []lineRange
+	for _, st := range structs {
+		if st.doc == nil || !strings.Contains(st.doc.Text(), c.structComment) {
+			continue
+		}
+
+		ranges = append(ranges, lineRange{
+			start: c.fset.Position(st.node.Pos()).Line,
+			end:   c.fset.Position(st.node.End()).Line,
+		})
+	}
+
+	if len(ranges) == 0 {
+		return 0, 0, fmt.Errorf("no struct with comment %q exists", c.structComment)
+	}
+
+	return c.selectRanges(ranges)
+}
+
+// structRegexSelection selects all structs whose name matches the struct
+// regex. If a field name is given, only the field of each struct is selected.
+func (c *config) structRegexSelection(file ast.Node) (int, int, error) {
+	return c.namedStructsSelection(file, c.structRegex.MatchString,
+		fmt.Sprintf("matching %q", c.structRegex))
+}
+
+// structImplementsSelection selects all structs that declare the method of
+// -struct-implements, i.e: a marker method such as IsEntity(). If a field name
+// is given, only the field of each struct is selected.
+func (c *config) structImplementsSelection(file ast.Node) (int, int, error) {
+	receivers := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		fn, ok := n.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) == 0 || fn.Name.Name != c.structImplements {
+			return true
+		}
+
+		// func (e *Entity) IsEntity() or func (e Entity[T]) IsEntity()
+		recv := deref(fn.Recv.List[0].Type)
+		switch t := recv.(type) {
+		case *ast.IndexExpr:
+			recv = t.X
+		case *ast.IndexListExpr:
+			recv = t.X
+		}
+
+		if ident, ok := recv.(*ast.Ident); ok {
+			receivers[ident.Name] = true
+		}
+		return false
+	})
+
+	return c.namedStructsSelection(file, func(name string) bool {
+		return receivers[name]
+	}, fmt.Sprintf("implementing %q", c.structImplements))
+}
+
+// namedStructsSelection selects all named structs whose name matches. If a
+// field name is given, only the field of each struct is selected. The
+// description of the matching structs is used in the error if no struct
+// matches, i.e: "matching \"DTO$\"".
+func (c *config) namedStructsSelection(file ast.Node, match func(name string) bool, desc string) (int, int, error) {
+	structs := collectStructs(file)
+
+	var ranges []lineRange
+	for _, st := range structs {
+		if st.name == "" || !match(st.name) {
+			continue
+		}
+
+		node := ast.Node(st.node)
+		if c.fieldName != "" {
+			field := findField(st.node, c.fieldName)
+			if field == nil {
+				continue
+			}
+			c.selectedFields = append(c.selectedFields, field)
+			node = field
+		}
+
+		ranges = append(ranges, lineRange{
+			start: c.fset.Position(node.Pos()).Line,
+			end:   c.fset.Position(node.End()).Line,
+		})
+	}
+
+	if len(ranges) == 0 {
+		if c.fieldName != "" {
+			return 0, 0, fmt.Errorf("no struct %s with field name %q exists", desc, c.fieldName)
+		}
+		return 0, 0, fmt.Errorf("no struct %s exists", desc)
+	}
+
+	return c.selectRanges(ranges)
+}
+
+// targetsSelection selects the targets in the form of "Struct.Field" or
+// "Struct"
+func (c *config) targetsSelection(file ast.Node) (int, int, error) {
+	var ranges []lineRange
+	for _, target := range c.targets {
+		structName, fieldName := target, ""
+		if i := strings.Index(target, "."); i != -1 {
+			structName, fieldName = target[:i], target[i+1:]
+		}
+
+		start, end, err := c.structFieldSelection(file, structName, fieldName)
+		if err != nil {
+			return 0, 0, fmt.Errorf("target %q: %s", target, err)
+		}
+
+		ranges = append(ranges, lineRange{start: start, end: end})
+	}
+
+	return c.selectRanges(ranges)
+}
+
+// selectRanges restricts the selection to the given line ranges and returns
+// the lines spanning all of them.
+func (c *config) selectRanges(ranges []lineRange) (int, int, error) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	c.ranges = ranges
+
+	start, end := ranges[0].start, ranges[0].end
+	for _, r := range ranges[1:] {
+		if r.end > end {
+			end = r.end
+		}
+	}
+
+	return start, end, nil
+}
+
+// inRanges reports whether the given line is inside the selected line ranges.
+// Every line is inside if there are no ranges.
+func (c *config) inRanges(line int) bool {
+	if len(c.ranges) == 0 {
+		return true
+	}
+
+	for _, r := range c.ranges {
+		if r.start <= line && line <= r.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// structLineSelection selects the fields of the struct that are inside the
+// line selection
+func (c *config) structLineSelection(file ast.Node) (int, int, error) {
+	structStart, structEnd, err := c.structSelection(file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start, end, err := c.lineSelection(file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if structStart > start {
+		start = structStart
+	}
+
+	if structEnd < end {
+		end = structEnd
+	}
+
+	if start > end {
+		return 0, 0, fmt.Errorf("line selection is outside of struct %q", c.structName)
 	}
+
+	return start, end, nil
 }
 
-func (c *config) process(fieldName, tagVal string) (string, error) {
-	var tag string
-	if tagVal != "" {
-		var err error
-		tag, err = strconv.Unquote(tagVal)
+func (c *config) fieldSelection(st *ast.StructType, structName, fieldName string) (int, int, error) {
+	encField := findField(st, fieldName)
+	if encField == nil {
+		return 0, 0, fmt.Errorf("struct %q doesn't have field name %q",
+			structName, fieldName)
+	}
+	c.selectedFields = append(c.selectedFields, encField)
+
+	start := c.fset.Position(encField.Pos()).Line
+	end := c.fset.Position(encField.End()).Line
+
+	return start, end, nil
+}
+
+// overSelected reports whether the given field is inside the selected lines
+// only because it's on the same line as a field selected with -field.
+func (c *config) overSelected(f *ast.Field) bool {
+	for _, sf := range c.selectedFields {
+		// the field itself or a field of its nested struct
+		if sf.Pos() <= f.Pos() && f.End() <= sf.End() {
+			return false
+		}
+	}
+
+	start, end := c.fset.Position(f.Pos()).Line, c.fset.Position(f.End()).Line
+	for _, sf := range c.selectedFields {
+		if start <= c.fset.Position(sf.End()).Line && c.fset.Position(sf.Pos()).Line <= end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findField returns the last field of the struct with the given name, or nil
+func findField(st *ast.StructType, fieldName string) *ast.Field {
+	var encField *ast.Field
+	for _, f := range st.Fields.List {
+		for _, field := range f.Names {
+			if field.Name == fieldName {
+				encField = f
+			}
+		}
+	}
+
+	return encField
+}
+
+func (c *config) offsetSelection(file ast.Node) (int, int, error) {
+	structs := collectStructs(file)
+
+	// select the innermost struct, i.e: a nested anonymous struct
+	var encStruct *ast.StructType
+	for _, st := range structs {
+		structBegin := c.fset.Position(st.node.Pos()).Offset
+		structEnd := c.fset.Position(st.node.End()).Offset
+		if c.fragment {
+			// the offsets are relative to the fragment
+			structBegin -= len(fragmentHeader)
+			structEnd -= len(fragmentHeader)
+		}
+
+		if structBegin <= c.offset && c.offset <= structEnd &&
+			(encStruct == nil || st.node.End()-st.node.Pos() < encStruct.End()-encStruct.Pos()) {
+			encStruct = st.node
+		}
+	}
+
+	if encStruct == nil {
+		return 0, 0, errors.New("offset is not inside a struct")
+	}
+
+	// the fields of the enclosing struct might be on the same lines
+	c.selectedStruct = encStruct
+
+	// offset selects all fields
+	start := c.fset.Position(encStruct.Pos()).Line
+	end := c.fset.Position(encStruct.End()).Line
+
+	return start, end, nil
+}
+
+// allSelection selects all structs inside a file
+func (c *config) allSelection(file ast.Node) (int, int, error) {
+	start := 1
+	end := c.fset.File(file.Pos()).LineCount()
+
+	return start, end, nil
+}
+
+// hasFieldName returns true if one of the names of the given field is name
+func hasFieldName(f *ast.Field, name string) bool {
+	for _, n := range f.Names {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isPublicName(name string) bool {
+	for _, c := range name {
+		return unicode.IsUpper(c)
+	}
+	return false
+}
+
+// isSkippedField returns true if the field name matches -skip-fields
+func (c *config) isSkippedField(name string) bool {
+	return c.skipFields != nil && c.skipFields.MatchString(name)
+}
+
+// rewrite rewrites the node for structs between the start and end
+// positions
+func (c *config) rewrite(node ast.Node, start, end int) (ast.Node, error) {
+	errs := &rewriteErrors{errs: make([]error, 0)}
+	structs := collectStructs(node)
+	interfaces := collectInterfaces(node)
+	imports := collectImports(node)
+	c.edits = make([]textEdit, 0)
+	c.structCount = len(structs)
+	c.reports = 0
+
+	var changes []*structChange
+	changed := make(map[*ast.StructType]*structChange)
+	change := func(x *ast.StructType) *structChange {
+		sc, ok := changed[x]
+		if !ok {
+			sc = &structChange{lineRange: lineRange{
+				start: c.fset.Position(x.Pos()).Line,
+				end:   c.fset.Position(x.End()).Line,
+			}}
+			changed[x] = sc
+			changes = append(changes, sc)
+		}
+		return sc
+	}
+
+	// the tags of the modified fields before they're modified, restored with
+	// -atomic if there are errors
+	type fieldTag struct {
+		field *ast.Field
+		tag   *ast.BasicLit
+		value string
+	}
+	var originals []fieldTag
+
+	// limited is the number of fields left unmodified due to maxFields
+	limited := 0
+
+	fieldErr := func(x *ast.StructType, f *ast.Field, err error) {
+		err = fmt.Errorf("%s:%d:%d:%s",
+			c.fset.Position(f.Pos()).Filename,
+			c.fset.Position(f.Pos()).Line,
+			c.fset.Position(f.Pos()).Column,
+			err)
+		errs.Append(err)
+
+		sc := change(x)
+		sc.errs = append(sc.errs, err.Error())
+	}
+
+	rewriteFunc := func(n ast.Node) bool {
+		x, ok := n.(*ast.StructType)
+		if !ok {
+			return true
+		}
+
+		if s := c.selectedStruct; s != nil && (x.Pos() < s.Pos() || x.End() > s.End()) {
+			return true
+		}
+
+		structName := ""
+		if st, ok := structs[x.Pos()]; ok {
+			structName = st.name
+		}
+
+		transform := ""
+		if c.inferCase {
+			transform = c.inferTransform(x)
+		}
+
+		var keyOrder []string
+		if c.consistentOrder {
+			keyOrder = structKeyOrder(x)
+		}
+
+		var inherited map[string]*structtag.Tags
+		if c.inheritEmbedded {
+			inherited = embeddedTags(x, structs)
+		}
+
+		selected := false
+		for i, f := range x.Fields.List {
+			line := c.fset.Position(f.Pos()).Line
+
+			if !(start <= line && line <= end) || !c.inRanges(line) || c.overSelected(f) {
+				continue
+			}
+			selected = true
+
+			fieldName := ""
+			if len(f.Names) != 0 {
+				for _, field := range f.Names {
+					// blank fields are padding and never tagged
+					if field.Name == "_" || c.isSkippedField(field.Name) {
+						continue
+					}
+
+					if !c.skipUnexportedFields || isPublicName(field.Name) {
+						fieldName = field.Name
+						break
+					}
+				}
+			}
+
+			// anonymous field
+			if f.Names == nil {
+				var ident *ast.Ident
+				switch t := f.Type.(type) {
+				case *ast.Ident:
+					ident = t
+				case *ast.SelectorExpr:
+					// embedded type of another package, i.e: sql.NullString
+					ident = t.Sel
+				}
+
+				if ident == nil {
+					continue
+				}
+
+				if !c.skipUnexportedFields && !c.isSkippedField(ident.Name) {
+					fieldName = ident.Name
+				}
+			}
+
+			// nothing to process, continue with next line
+			if fieldName == "" {
+				continue
+			}
+
+			// -field together with -all selects the field in every struct
+			if c.all && c.fieldName != "" && !hasFieldName(f, c.fieldName) {
+				continue
+			}
+
+			if c.skipInterfaceFields && c.isInterface(f.Type, interfaces, imports) {
+				continue
+			}
+
+			tagVal := ""
+			if f.Tag != nil {
+				tagVal = f.Tag.Value
+			}
+
+			if c.hasSkippedTagValue(tagVal) {
+				continue
+			}
+
+			baseName := ""
+			if c.commentNames {
+				baseName = commentName(f)
+			}
+
+			res, err := c.process(fieldInfo{
+				name:       fieldName,
+				structName: structName,
+				index:      i + 1,
+				embedded:   f.Names == nil,
+				keyOrder:   keyOrder,
+				transform:  transform,
+				doc:        fieldDoc(f),
+				baseName:   baseName,
+				inherited:  inherited[fieldName],
+			}, tagVal)
+			if err != nil {
+				fieldErr(x, f, err)
+				continue
+			}
+
+			if res != tagVal && c.maxFields > 0 && len(c.edits) >= c.maxFields {
+				limited++
+				continue
+			}
+
+			if res != tagVal {
+				c.edits = append(c.edits, c.tagEdit(f, res))
+				sc := change(x)
+				sc.modified = append(sc.modified, modifiedField{
+					Field:  fieldName,
+					Line:   line,
+					OldTag: unquoteTag(tagVal),
+					NewTag: unquoteTag(res),
+				})
+				originals = append(originals, fieldTag{field: f, tag: f.Tag, value: tagVal})
+			}
+
+			c.recordMapping(structName, fieldName, res)
+
+			if res == "" {
+				// no tags are left, remove the literal entirely, otherwise
+				// the empty literal is printed as trailing whitespace
+				f.Tag = nil
+				continue
+			}
+
+			if f.Tag == nil {
+				f.Tag = &ast.BasicLit{}
+			}
+
+			f.Tag.Value = res
+		}
+
+		if selected {
+			report := func(f *ast.Field, err error) {
+				c.reports++
+				fieldErr(x, f, err)
+			}
+			c.collisions(x, report)
+			c.inconsistentCases(x, report)
+		}
+
+		return true
+	}
+
+	ast.Inspect(node, rewriteFunc)
+
+	if limited != 0 {
+		c.reports++
+		errs.Append(fmt.Errorf("stopped after modifying %d fields, -max-fields is reached: %d more fields are not modified",
+			c.maxFields, limited))
+	}
+
+	if c.atomic && len(errs.errs) != 0 {
+		// leave the node as it is, only the errors are reported
+		for _, o := range originals {
+			o.field.Tag = o.tag
+			if o.tag != nil {
+				o.tag.Value = o.value
+			}
+		}
+		c.edits = make([]textEdit, 0)
+		c.mapping = nil
+		for _, sc := range changes {
+			sc.modified = nil
+		}
+	}
+
+	c.start = start
+	c.end = end
+	c.structChanges = mergeStructChanges(changes)
+
+	if len(errs.errs) == 0 {
+		return node, nil
+	}
+
+	return node, errs
+}
+
+// structKeyOrder returns the keys of the existing tags of the given struct,
+// ordered by their average position inside the tags. Keys with the same
+// average position are ordered by their first appearance.
+func structKeyOrder(x *ast.StructType) []string {
+	var keys []string
+	sum := make(map[string]int)
+	count := make(map[string]int)
+
+	for _, f := range x.Fields.List {
+		if f.Tag == nil {
+			continue
+		}
+
+		tag, err := strconv.Unquote(f.Tag.Value)
 		if err != nil {
-			return "", err
+			continue
+		}
+
+		tags, err := structtag.Parse(normalizeTagSpace(tag))
+		if err != nil {
+			continue
+		}
+
+		for i, key := range tags.Keys() {
+			if count[key] == 0 {
+				keys = append(keys, key)
+			}
+			sum[key] += i
+			count[key]++
+		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		// compare sum[i]/count[i] < sum[j]/count[j] without rounding
+		return sum[keys[i]]*count[keys[j]] < sum[keys[j]]*count[keys[i]]
+	})
+
+	return keys
+}
+
+// orderTags orders the tags by the given order of keys. Keys that are not
+// part of the order are moved to the end, keeping their relative order.
+func orderTags(tags *structtag.Tags, order []string) {
+	index := make(map[string]int, len(order))
+	for i, key := range order {
+		index[key] = i
+	}
+
+	rank := func(t *structtag.Tag) int {
+		if i, ok := index[t.Key]; ok {
+			return i
+		}
+		return len(order)
+	}
+
+	list := tags.Tags()
+	sort.SliceStable(list, func(i, j int) bool {
+		return rank(list[i]) < rank(list[j])
+	})
+}
+
+// inferTransform returns the dominant case of the existing tag names of the
+// keys to be added in the given struct, i.e: "camelcase" if most of the json
+// tags are in the form of `json:"userName"`. It returns an empty string if
+// there is no dominant case.
+func (c *config) inferTransform(x *ast.StructType) string {
+	counts := make(map[string]int)
+	for _, f := range x.Fields.List {
+		if f.Tag == nil {
+			continue
+		}
+
+		tag, err := strconv.Unquote(f.Tag.Value)
+		if err != nil {
+			continue
+		}
+
+		tags, err := structtag.Parse(normalizeTagSpace(tag))
+		if err != nil {
+			continue
+		}
+
+		for _, key := range c.add {
+			// keys with a static value aren't transformed
+			if strings.Contains(key, ":") {
+				continue
+			}
+
+			t, err := tags.Get(key)
+			if err != nil {
+				continue
+			}
+
+			if transform := detectCase(t.Name); transform != "" {
+				counts[transform]++
+			}
 		}
 	}
 
-	tags, err := structtag.Parse(tag)
-	if err != nil {
-		return "", err
+	dominant, max := "", 0
+	for transform, n := range counts {
+		if n > max {
+			dominant, max = transform, n
+		} else if n == max {
+			// a tie, there is no dominant case
+			dominant = ""
+		}
 	}
 
-	tags = c.removeTags(tags)
-	tags, err = c.removeTagOptions(tags)
-	if err != nil {
-		return "", err
+	return dominant
+}
+
+// detectCase returns the transform that results in the given tag name. It
+// returns an empty string if the case is unknown or ambiguous, i.e: "name" is
+// both snakecase and camelcase.
+func detectCase(name string) string {
+	if name == "" || name == "-" {
+		return ""
 	}
 
-	tags = c.clearTags(tags)
-	tags = c.clearOptions(tags)
+	hasUpper := strings.ToLower(name) != name
+	hasUnderscore := strings.Contains(name, "_")
+	hasDash := strings.Contains(name, "-")
+
+	switch {
+	case hasUnderscore && !hasDash && !hasUpper:
+		return "snakecase"
+	case hasDash && !hasUnderscore && !hasUpper:
+		return "lispcase"
+	case hasUnderscore || hasDash || !hasUpper:
+		return ""
+	case isUpper(name[0]):
+		return "pascalcase"
+	default:
+		return "camelcase"
+	}
+}
 
-	tags, err = c.addTags(fieldName, tags)
-	if err != nil {
-		return "", err
+// hasSkippedTagValue returns true if the tag has one of the key and name
+// pairs of the fields to be skipped, i.e: `json:"-"`
+func (c *config) hasSkippedTagValue(tagVal string) bool {
+	if len(c.skipTagValues) == 0 || tagVal == "" {
+		return false
 	}
 
-	tags, err = c.addTagOptions(tags)
+	tag, err := strconv.Unquote(tagVal)
 	if err != nil {
-		return "", err
+		return false
 	}
 
-	if c.sort {
-		sort.Sort(tags)
+	tags, err := structtag.Parse(normalizeTagSpace(tag))
+	if err != nil {
+		return false
 	}
 
-	res := tags.String()
-	if res != "" {
-		res = quote(tags.String())
+	for key, name := range c.skipTagValues {
+		if t, err := tags.Get(key); err == nil && t.Name == name {
+			return true
+		}
 	}
 
-	return res, nil
+	return false
 }
 
-func (c *config) removeTags(tags *structtag.Tags) *structtag.Tags {
-	if c.remove == nil || len(c.remove) == 0 {
-		return tags
+// recordMapping records the tag name of the first key to be added of the
+// given field, if the mapping is requested. Fields of anonymous structs are
+// skipped.
+func (c *config) recordMapping(structName, fieldName, tagVal string) {
+	if (c.mappingReport == "" && c.output != "yaml") || structName == "" || tagVal == "" {
+		return
 	}
 
-	tags.Delete(c.remove...)
-	return tags
-}
-
-func (c *config) clearTags(tags *structtag.Tags) *structtag.Tags {
-	if !c.clear {
-		return tags
+	tag, err := strconv.Unquote(tagVal)
+	if err != nil {
+		return
 	}
 
-	tags.Delete(tags.Keys()...)
-	return tags
-}
-
-func (c *config) clearOptions(tags *structtag.Tags) *structtag.Tags {
-	if !c.clearOption {
-		return tags
+	tags, err := structtag.Parse(normalizeTagSpace(tag))
+	if err != nil {
+		return
 	}
 
-	for _, t := range tags.Tags() {
-		t.Options = nil
+	key := strings.SplitN(c.add[0], ":", 2)[0]
+	t, err := tags.Get(key)
+	if err != nil {
+		return
 	}
 
-	return tags
-}
-
-func (c *config) removeTagOptions(tags *structtag.Tags) (*structtag.Tags, error) {
-	if c.removeOptions == nil || len(c.removeOptions) == 0 {
-		return tags, nil
+	if c.mapping == nil {
+		c.mapping = make(map[string]map[string]string)
 	}
 
-	for _, val := range c.removeOptions {
-		// syntax key=option
-		splitted := strings.Split(val, "=")
-		if len(splitted) < 2 {
-			return nil, errors.New("wrong syntax to remove an option. i.e key=option")
-		}
-
-		key := splitted[0]
-		option := strings.Join(splitted[1:], "=")
-
-		tags.DeleteOptions(key, option)
+	if c.mapping[structName] == nil {
+		c.mapping[structName] = make(map[string]string)
 	}
 
-	return tags, nil
+	c.mapping[structName][fieldName] = t.Name
 }
 
-func (c *config) addTagOptions(tags *structtag.Tags) (*structtag.Tags, error) {
-	if c.addOptions == nil || len(c.addOptions) == 0 {
-		return tags, nil
+// writeMapping writes the recorded mapping as JSON to the given file
+func (c *config) writeMapping(filename string) error {
+	mapping := c.mapping
+	if mapping == nil {
+		mapping = make(map[string]map[string]string)
 	}
 
-	for _, val := range c.addOptions {
-		// syntax key=option
-		splitted := strings.Split(val, "=")
-		if len(splitted) < 2 {
-			return nil, errors.New("wrong syntax to add an option. i.e key=option")
-		}
-
-		key := splitted[0]
-		option := strings.Join(splitted[1:], "=")
-
-		tags.AddOptions(key, option)
+	out, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
 	}
 
-	return tags, nil
+	return ioutil.WriteFile(filename, append(out, '\n'), 0644)
 }
 
-func (c *config) addTags(fieldName string, tags *structtag.Tags) (*structtag.Tags, error) {
-	if c.add == nil || len(c.add) == 0 {
-		return tags, nil
+// mappingYAML returns the mapping in the form of a YAML document, with the
+// structs and fields sorted by name
+func mappingYAML(mapping map[string]map[string]string) string {
+	if len(mapping) == 0 {
+		return "{}"
 	}
 
-	splitted := camelcase.Split(fieldName)
-	name := ""
-
-	unknown := false
-	switch c.transform {
-	case "snakecase":
-		var lowerSplitted []string
-		for _, s := range splitted {
-			s = strings.Trim(s, "_")
-			if s == "" {
-				continue
-			}
-			lowerSplitted = append(lowerSplitted, strings.ToLower(s))
-		}
-
-		name = strings.Join(lowerSplitted, "_")
-	case "lispcase":
-		var lowerSplitted []string
-		for _, s := range splitted {
-			lowerSplitted = append(lowerSplitted, strings.ToLower(s))
-		}
-
-		name = strings.Join(lowerSplitted, "-")
-	case "camelcase":
-		var titled []string
-		for _, s := range splitted {
-			titled = append(titled, strings.Title(s))
-		}
+	structNames := make([]string, 0, len(mapping))
+	for structName := range mapping {
+		structNames = append(structNames, structName)
+	}
+	sort.Strings(structNames)
 
-		titled[0] = strings.ToLower(titled[0])
+	var lines []string
+	for _, structName := range structNames {
+		lines = append(lines, yamlScalar(structName)+":")
 
-		name = strings.Join(titled, "")
-	case "pascalcase":
-		var titled []string
-		for _, s := range splitted {
-			titled = append(titled, strings.Title(s))
+		fields := mapping[structName]
+		fieldNames := make([]string, 0, len(fields))
+		for fieldName := range fields {
+			fieldNames = append(fieldNames, fieldName)
 		}
+		sort.Strings(fieldNames)
 
-		name = strings.Join(titled, "")
-	case "titlecase":
-		var titled []string
-		for _, s := range splitted {
-			titled = append(titled, strings.Title(s))
+		for _, fieldName := range fieldNames {
+			lines = append(lines, "  "+yamlScalar(fieldName)+": "+yamlScalar(fields[fieldName]))
 		}
-
-		name = strings.Join(titled, " ")
-	case "keep":
-		name = fieldName
-	default:
-		unknown = true
 	}
 
-	if c.valueFormat != "" {
-		prevName := name
-		name = strings.ReplaceAll(c.valueFormat, "{field}", name)
-		if name == c.valueFormat {
-			// support old style for backward compatibility
-			name = strings.ReplaceAll(c.valueFormat, "$field", prevName)
-		}
-	}
+	return strings.Join(lines, "\n")
+}
 
-	for _, key := range c.add {
-		splitted = strings.SplitN(key, ":", 2)
-		if len(splitted) >= 2 {
-			key = splitted[0]
-			name = strings.Join(splitted[1:], "")
-		} else if unknown {
-			// the user didn't pass any value but want to use an unknown
-			// transform. We don't return above in the default as the user
-			// might pass a value
-			return nil, fmt.Errorf("unknown transform option %q", c.transform)
-		}
+// plainYAML matches the strings that don't need to be quoted in YAML
+var plainYAML = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_./-]*$`)
 
-		tag, err := tags.Get(key)
-		if err != nil {
-			// tag doesn't exist, create a new one
-			tag = &structtag.Tag{
-				Key:  key,
-				Name: name,
-			}
-		} else if c.override {
-			tag.Name = name
-		}
+// yamlScalar returns s as a YAML scalar. Strings that could be read as
+// another type or contain special characters are double quoted.
+func yamlScalar(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null", "~":
+		return strconv.Quote(s)
+	}
 
-		if err := tags.Set(tag); err != nil {
-			return nil, err
-		}
+	if plainYAML.MatchString(s) {
+		return s
 	}
 
-	return tags, nil
+	return strconv.Quote(s)
 }
 
-// collectStructs collects and maps structType nodes to their positions
-func collectStructs(node ast.Node) map[token.Pos]*structType {
-	structs := make(map[token.Pos]*structType, 0)
+// collisions reports the fields of the given struct that have the same tag
+// name as a previous field for one of the collision keys, i.e: two fields
+// with `json:"id"`
+func (c *config) collisions(x *ast.StructType, report func(*ast.Field, error)) {
+	for _, key := range c.collisionKeys {
+		seen := make(map[string]string)
+		for _, f := range x.Fields.List {
+			if f.Tag == nil {
+				continue
+			}
 
-	collectStructs := func(n ast.Node) bool {
-		var t ast.Expr
-		var structName string
+			tag, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				continue
+			}
 
-		switch x := n.(type) {
-		case *ast.TypeSpec:
-			if x.Type == nil {
-				return true
+			tags, err := structtag.Parse(normalizeTagSpace(tag))
+			if err != nil {
+				continue
+			}
 
+			t, err := tags.Get(key)
+			if err != nil || t.Name == "" || t.Name == "-" {
+				continue
 			}
 
-			structName = x.Name.Name
-			t = x.Type
-		case *ast.CompositeLit:
-			t = x.Type
-		case *ast.ValueSpec:
-			structName = x.Names[0].Name
-			t = x.Type
-		case *ast.Field:
-			// this case also catches struct fields and the structName
-			// therefore might contain the field name (which is wrong)
-			// because `x.Type` in this case is not a *ast.StructType.
-			//
-			// We're OK with it, because, in our case *ast.Field represents
-			// a parameter declaration, i.e:
-			//
-			//   func test(arg struct {
-			//   	Field int
-			//   }) {
-			//   }
-			//
-			// and hence the struct name will be `arg`.
-			if len(x.Names) != 0 {
-				structName = x.Names[0].Name
+			fieldName := "embedded field"
+			if len(f.Names) != 0 {
+				fieldName = f.Names[0].Name
 			}
-			t = x.Type
-		}
 
-		// if expression is in form "*T" or "[]T", dereference to check if "T"
-		// contains a struct expression
-		t = deref(t)
+			if prev, ok := seen[t.Name]; ok {
+				report(f, fmt.Errorf("%s tag name %q of field %s collides with field %s",
+					key, t.Name, fieldName, prev))
+				continue
+			}
 
-		x, ok := t.(*ast.StructType)
-		if !ok {
-			return true
+			seen[t.Name] = fieldName
 		}
+	}
+}
 
-		structs[x.Pos()] = &structType{
-			name: structName,
-			node: x,
-		}
-		return true
+// inconsistentCases reports the fields of the given struct whose tag names
+// differ from the dominant case of the inconsistent case keys, i.e: a
+// camelcase json tag in a struct of snakecase json tags. If there is a tie,
+// the case of the first field is dominant.
+func (c *config) inconsistentCases(x *ast.StructType, report func(*ast.Field, error)) {
+	type caseField struct {
+		field *ast.Field
+		name  string
+		tag   string
+		kind  string
 	}
 
-	ast.Inspect(node, collectStructs)
-	return structs
-}
+	for _, key := range c.inconsistentCaseKeys {
+		var fields []caseField
+		counts := make(map[string]int)
+		for _, f := range x.Fields.List {
+			if f.Tag == nil {
+				continue
+			}
 
-func (c *config) format(file ast.Node, rwErrs error) (string, error) {
-	switch c.output {
-	case "source":
-		var buf bytes.Buffer
-		err := format.Node(&buf, c.fset, file)
-		if err != nil {
-			return "", err
-		}
+			tag, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				continue
+			}
 
-		if c.write {
-			err = ioutil.WriteFile(c.file, buf.Bytes(), 0)
+			tags, err := structtag.Parse(normalizeTagSpace(tag))
 			if err != nil {
-				return "", err
+				continue
 			}
-		}
 
-		return buf.String(), nil
-	case "json":
-		// NOTE(arslan): print first the whole file and then cut out our
-		// selection. The reason we don't directly print the struct is that the
-		// printer is not capable of printing loosy comments, comments that are
-		// not part of any field inside a struct. Those are part of *ast.File
-		// and only printed inside a struct if we print the whole file. This
-		// approach is the sanest and simplest way to get a struct printed
-		// back. Second, our cursor might intersect two different structs with
-		// other declarations in between them. Printing the file and cutting
-		// the selection is the easier and simpler to do.
-		var buf bytes.Buffer
-
-		// this is the default config from `format.Node()`, but we add
-		// `printer.SourcePos` to get the original source position of the
-		// modified lines
-		cfg := printer.Config{Mode: printer.SourcePos | printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
-		err := cfg.Fprint(&buf, c.fset, file)
-		if err != nil {
-			return "", err
-		}
+			t, err := tags.Get(key)
+			if err != nil {
+				continue
+			}
 
-		lines, err := parseLines(&buf)
-		if err != nil {
-			return "", err
-		}
+			// single words, such as "name", fit any case
+			kind := detectCase(t.Name)
+			if kind == "" {
+				continue
+			}
 
-		// prevent selection to be larger than the actual number of lines
-		if c.start > len(lines) || c.end > len(lines) {
-			return "", errors.New("line selection is invalid")
+			fieldName := "embedded field"
+			if len(f.Names) != 0 {
+				fieldName = f.Names[0].Name
+			}
+
+			fields = append(fields, caseField{field: f, name: fieldName, tag: t.Name, kind: kind})
+			counts[kind]++
 		}
 
-		out := &output{
-			Start: c.start,
-			End:   c.end,
-			Lines: lines[c.start-1 : c.end],
+		if len(counts) < 2 {
+			continue
+		}
+
+		dominant := ""
+		for _, cf := range fields {
+			if dominant == "" || counts[cf.kind] > counts[dominant] {
+				dominant = cf.kind
+			}
 		}
 
-		if rwErrs != nil {
-			if r, ok := rwErrs.(*rewriteErrors); ok {
-				for _, err := range r.errs {
-					out.Errors = append(out.Errors, err.Error())
-				}
+		for _, cf := range fields {
+			if cf.kind != dominant {
+				report(cf.field, fmt.Errorf("%s tag name %q of field %s is %s instead of %s",
+					key, cf.tag, cf.name, cf.kind, dominant))
 			}
 		}
+	}
+}
 
-		o, err := json.MarshalIndent(out, "", "  ")
-		if err != nil {
-			return "", err
+// structChange is a struct with modified or failed fields
+type structChange struct {
+	lineRange
+	errs     []string
+	modified []modifiedField
+}
+
+// mergeStructChanges sorts the given changes by their position and merges
+// nested structs into their enclosing struct.
+func mergeStructChanges(changes []*structChange) []*structChange {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].start < changes[j].start
+	})
+
+	var merged []*structChange
+	for _, sc := range changes {
+		if len(merged) != 0 {
+			last := merged[len(merged)-1]
+			if sc.end <= last.end {
+				last.errs = append(last.errs, sc.errs...)
+				last.modified = append(last.modified, sc.modified...)
+				sort.SliceStable(last.modified, func(i, j int) bool {
+					return last.modified[i].Line < last.modified[j].Line
+				})
+				continue
+			}
 		}
 
-		return string(o), nil
+		merged = append(merged, sc)
+	}
+
+	return merged
+}
+
+// tagEdit returns the edit that changes the tag literal of the given field to
+// the given tag. It must be called before the field is modified.
+func (c *config) tagEdit(f *ast.Field, tag string) textEdit {
+	switch {
+	case f.Tag == nil:
+		// insert a new tag after the type
+		pos := c.editPosition(f.Type.End())
+		return textEdit{
+			Range:   editRange{Start: pos, End: pos},
+			NewText: " " + tag,
+			start:   c.byteOffset(f.Type.End()),
+			end:     c.byteOffset(f.Type.End()),
+		}
+	case tag == "":
+		// remove the tag including the whitespace in front of it
+		return textEdit{
+			Range: editRange{
+				Start: c.editPosition(f.Type.End()),
+				End:   c.editPosition(f.Tag.End()),
+			},
+			start: c.byteOffset(f.Type.End()),
+			end:   c.byteOffset(f.Tag.End()),
+		}
 	default:
-		return "", fmt.Errorf("unknown output mode: %s", c.output)
+		return textEdit{
+			Range: editRange{
+				Start: c.editPosition(f.Tag.Pos()),
+				End:   c.editPosition(f.Tag.End()),
+			},
+			NewText: tag,
+			start:   c.byteOffset(f.Tag.Pos()),
+			end:     c.byteOffset(f.Tag.End()),
+		}
 	}
 }
 
-func (c *config) lineSelection(file ast.Node) (int, int, error) {
-	var err error
-	splitted := strings.Split(c.line, ",")
+// byteOffset returns the byte offset of pos in the source
+func (c *config) byteOffset(pos token.Pos) int {
+	return c.fset.PositionFor(pos, false).Offset
+}
 
-	start, err := strconv.Atoi(splitted[0])
-	if err != nil {
-		return 0, 0, err
+// editPosition converts the given position to a LSP position
+func (c *config) editPosition(pos token.Pos) editPosition {
+	p := c.fset.PositionFor(pos, false)
+	lineStart := p.Offset - (p.Column - 1)
+
+	return editPosition{
+		Line:      p.Line - 1,
+		Character: len(utf16.Encode([]rune(string(c.src[lineStart:p.Offset])))),
 	}
+}
 
-	end := start
-	if len(splitted) == 2 {
-		end, err = strconv.Atoi(splitted[1])
-		if err != nil {
-			return 0, 0, err
-		}
+// matchFile reports whether the base name or the path relative to dir of the
+// given file of dir matches the file pattern
+func (c *config) matchFile(path string) bool {
+	if ok, _ := filepath.Match(c.filePattern, filepath.Base(path)); ok {
+		return true
 	}
 
-	if start > end {
-		return 0, 0, errors.New("wrong range. start line cannot be larger than end line")
+	rel, err := filepath.Rel(c.dir, path)
+	if err != nil {
+		return false
 	}
 
-	return start, end, nil
+	ok, _ := filepath.Match(c.filePattern, rel)
+	return ok
 }
 
-func (c *config) structSelection(file ast.Node) (int, int, error) {
-	structs := collectStructs(file)
+// validateDir validates the flags used together with -dir, which selects all
+// structs of each file
+func (c *config) validateDir() error {
+	if c.file != "" || c.modified != nil {
+		return errors.New("-dir cannot be used together with -file or -modified")
+	}
 
-	var encStruct *ast.StructType
-	for _, st := range structs {
-		if st.name == c.structName {
-			encStruct = st.node
-		}
+	if c.line != "" || c.lines != "" || c.offset != 0 || c.structName != "" || c.structComment != "" ||
+		c.structRegex != nil || c.structImplements != "" || len(c.targets) != 0 {
+		return errors.New("-dir selects all structs, it cannot be used together with -line, -lines, " +
+			"-offset, -struct, -struct-with-comment, -struct-regex, -struct-implements or -targets")
 	}
 
-	if encStruct == nil {
-		return 0, 0, errors.New("struct name does not exist")
+	if c.mappingReport != "" || c.maxFields != 0 || c.output == "yaml" {
+		return errors.New("-dir cannot be used together with -mapping-report, -max-fields or -format yaml")
 	}
 
-	// if field name has been specified as well, only select the given field
-	if c.fieldName != "" {
-		return c.fieldSelection(encStruct)
+	// only the sources and the diffs of the written files are printed
+	if c.write && (c.output == "json" || c.output == "json-per-struct" || c.output == "text-edits") {
+		return errors.New("-dir -w cannot be used together with -format json, json-per-struct or text-edits")
 	}
 
-	start := c.fset.Position(encStruct.Pos()).Line
-	end := c.fset.Position(encStruct.End()).Line
+	// the outputs of the files can't be told apart otherwise
+	if !c.write && !c.quiet && !c.stat && !c.dryRun && !c.reportMismatches && c.output != "diff" {
+		return errors.New("-dir is requiring -w, -quiet, -stat, -dry-run, -report-mismatches or -format diff")
+	}
 
-	return start, end, nil
+	return nil
 }
 
-func (c *config) fieldSelection(st *ast.StructType) (int, int, error) {
-	var encField *ast.Field
-	for _, f := range st.Fields.List {
-		for _, field := range f.Names {
-			if field.Name == c.fieldName {
-				encField = f
-			}
-		}
+// validateEditor validates the flags used together with -editor, which reads
+// the file, the selection and the operations from the request
+func (c *config) validateEditor() error {
+	if c.file != "" || c.dir != "" || c.stdin != nil || c.modified != nil {
+		return errors.New("-editor cannot be used together with -file, -dir, -stdin or -modified")
 	}
 
-	if encField == nil {
-		return 0, 0, fmt.Errorf("struct %q doesn't have field name %q",
-			c.structName, c.fieldName)
+	if c.write || c.quiet || c.stat || c.dryRun || c.output != "source" {
+		return errors.New("-editor writes a JSON response, it cannot be used together with " +
+			"-w, -quiet, -stat, -dry-run or -format")
 	}
 
-	start := c.fset.Position(encField.Pos()).Line
-	end := c.fset.Position(encField.End()).Line
+	if c.line != "" || c.lines != "" || c.offset != 0 || c.structName != "" || c.structComment != "" ||
+		c.structRegex != nil || c.structImplements != "" || len(c.targets) != 0 || c.all ||
+		len(c.add) != 0 || len(c.remove) != 0 || c.clear || len(c.addOptions) != 0 ||
+		len(c.removeOptions) != 0 || c.clearOption {
+		return errors.New("-editor reads the selection and the operations from the request, " +
+			"they cannot be passed as flags")
+	}
 
-	return start, end, nil
+	return nil
 }
 
-func (c *config) offsetSelection(file ast.Node) (int, int, error) {
-	structs := collectStructs(file)
-
-	var encStruct *ast.StructType
-	for _, st := range structs {
-		structBegin := c.fset.Position(st.node.Pos()).Offset
-		structEnd := c.fset.Position(st.node.End()).Offset
-
-		if structBegin <= c.offset && c.offset <= structEnd {
-			encStruct = st.node
-			break
-		}
+// validate validates whether the config is valid or not
+func (c *config) validate() error {
+	if c.editor {
+		return c.validateEditor()
 	}
 
-	if encStruct == nil {
-		return 0, 0, errors.New("offset is not inside a struct")
+	if c.file == "" && c.dir == "" {
+		return errors.New("no file is passed")
 	}
 
-	// offset selects all fields
-	start := c.fset.Position(encStruct.Pos()).Line
-	end := c.fset.Position(encStruct.End()).Line
+	if c.stdin != nil && (c.write || c.modified != nil || c.dir != "") {
+		return errors.New("-stdin cannot be used together with -w, -modified or -dir")
+	}
 
-	return start, end, nil
-}
+	if c.dir != "" {
+		if err := c.validateDir(); err != nil {
+			return err
+		}
+	}
 
-// allSelection selects all structs inside a file
-func (c *config) allSelection(file ast.Node) (int, int, error) {
-	start := 1
-	end := c.fset.File(file.Pos()).LineCount()
+	if c.stats && c.dir == "" {
+		return errors.New("-stats is requiring -dir")
+	}
 
-	return start, end, nil
-}
+	if c.filePattern != "" {
+		if c.dir == "" {
+			return errors.New("-file-pattern is requiring -dir")
+		}
 
-func isPublicName(name string) bool {
-	for _, c := range name {
-		return unicode.IsUpper(c)
+		if _, err := filepath.Match(c.filePattern, ""); err != nil {
+			return fmt.Errorf("invalid -file-pattern %q: %s", c.filePattern, err)
+		}
 	}
-	return false
-}
-
-// rewrite rewrites the node for structs between the start and end
-// positions
-func (c *config) rewrite(node ast.Node, start, end int) (ast.Node, error) {
-	errs := &rewriteErrors{errs: make([]error, 0)}
 
-	rewriteFunc := func(n ast.Node) bool {
-		x, ok := n.(*ast.StructType)
-		if !ok {
-			return true
+	var selections []string
+	for _, s := range []struct {
+		flag   string
+		passed bool
+	}{
+		{"-line", c.line != ""},
+		{"-lines", c.lines != ""},
+		{"-offset", c.offset != 0},
+		{"-struct", c.structName != ""},
+		{"-struct-with-comment", c.structComment != ""},
+		{"-struct-regex", c.structRegex != nil},
+		{"-struct-implements", c.structImplements != ""},
+		{"-targets", len(c.targets) != 0},
+		{"-all", c.all},
+	} {
+		if s.passed {
+			selections = append(selections, s.flag)
 		}
+	}
 
-		for _, f := range x.Fields.List {
-			line := c.fset.Position(f.Pos()).Line
+	if len(selections) == 0 && c.dir == "" {
+		return errNoSelection
+	}
 
-			if !(start <= line && line <= end) {
-				continue
-			}
+	// -line together with -struct selects the fields of the struct inside the
+	// lines, the other selections can't be combined
+	if len(selections) > 1 && !(len(selections) == 2 && c.line != "" && c.structName != "") {
+		return fmt.Errorf("%s and %s cannot be used together. pick one",
+			strings.Join(selections[:len(selections)-1], ", "), selections[len(selections)-1])
+	}
 
-			fieldName := ""
-			if len(f.Names) != 0 {
-				for _, field := range f.Names {
-					if !c.skipUnexportedFields || isPublicName(field.Name) {
-						fieldName = field.Name
-						break
-					}
-				}
-			}
+	operations := []struct {
+		flag    string
+		defined bool
+	}{
+		{"-add-tags", len(c.add) != 0},
+		{"-add-options", len(c.addOptions) != 0},
+		{"-remove-tags", len(c.remove) != 0},
+		{"-remove-options", len(c.removeOptions) != 0},
+		{"-remove-ignored", len(c.removeIgnored) != 0},
+		{"-rename-tags", len(c.rename) != 0},
+		{"-keep-tags", len(c.keep) != 0},
+		{"-clear-tags", c.clear},
+		{"-clear-keys", len(c.clearKeys) != 0},
+		{"-clear-options", c.clearOption},
+		{"-dedupe-options", c.dedupe},
+		{"-option-aliases", len(c.optionAliases) != 0},
+		{"-canonical", c.canonical},
+		{"-consistent-order", c.consistentOrder},
+		{"-detect-inconsistent-case", len(c.inconsistentCaseKeys) != 0},
+	}
 
-			// anonymous field
-			if f.Names == nil {
-				ident, ok := f.Type.(*ast.Ident)
-				if !ok {
-					continue
-				}
+	var flags []string
+	defined := false
+	for _, op := range operations {
+		flags = append(flags, op.flag)
+		defined = defined || op.defined
+	}
 
-				if !c.skipUnexportedFields {
-					fieldName = ident.Name
-				}
-			}
+	if !defined {
+		return fmt.Errorf("one of [%s] should be defined", strings.Join(flags, ", "))
+	}
 
-			// nothing to process, continue with next line
-			if fieldName == "" {
-				continue
-			}
+	if c.fieldName != "" && c.structName == "" && c.structRegex == nil && c.structImplements == "" && !c.all {
+		return errors.New("-field is requiring -struct, -struct-regex, -struct-implements or -all")
+	}
 
-			if f.Tag == nil {
-				f.Tag = &ast.BasicLit{}
-			}
+	if c.occurrence < 0 {
+		return errors.New("-occurrence should be a positive number")
+	}
 
-			res, err := c.process(fieldName, f.Tag.Value)
-			if err != nil {
-				errs.Append(fmt.Errorf("%s:%d:%d:%s",
-					c.fset.Position(f.Pos()).Filename,
-					c.fset.Position(f.Pos()).Line,
-					c.fset.Position(f.Pos()).Column,
-					err))
-				continue
-			}
+	if c.occurrence != 0 && c.structName == "" {
+		return errors.New("-occurrence is requiring -struct")
+	}
 
-			f.Tag.Value = res
-		}
+	if c.reportMismatches && (c.add == nil || len(c.add) == 0) {
+		return errors.New("-report-mismatches is requiring -add-tags")
+	}
 
-		return true
+	if c.removeOptionIfLast && len(c.removeOptions) == 0 {
+		return errors.New("-remove-option-if-last is requiring -remove-options")
 	}
 
-	ast.Inspect(node, rewriteFunc)
+	if c.fragment && (c.output != "source" || c.stat || c.force || c.dir != "") {
+		return errors.New("-fragment is requiring -format source and cannot be used together with -stat, -force or -dir")
+	}
 
-	c.start = start
-	c.end = end
+	if c.maxFields < 0 {
+		return errors.New("-max-fields cannot be negative")
+	}
 
-	if len(errs.errs) == 0 {
-		return node, nil
+	if c.noWriteOnError && !c.write {
+		return errors.New("-no-write-on-error is requiring -w")
 	}
 
-	return node, errs
-}
+	if c.createOptionTags && len(c.addOptions) == 0 {
+		return errors.New("-create-option-tags is requiring -add-options")
+	}
 
-// validate validates whether the config is valid or not
-func (c *config) validate() error {
-	if c.file == "" {
-		return errors.New("no file is passed")
+	if c.mappingReport != "" && len(c.add) == 0 {
+		return errors.New("-mapping-report is requiring -add-tags")
 	}
 
-	if c.line == "" && c.offset == 0 && c.structName == "" && !c.all {
-		return errors.New("-line, -offset, -struct or -all is not passed")
+	if c.dryRun && c.write {
+		return errors.New("-dry-run cannot be used together with -w")
 	}
 
-	if c.line != "" && c.offset != 0 ||
-		c.line != "" && c.structName != "" ||
-		c.offset != 0 && c.structName != "" {
-		return errors.New("-line, -offset or -struct cannot be used together. pick one")
+	if c.stat && c.output != "source" {
+		return errors.New("-stat is requiring -format source")
 	}
 
-	if (c.add == nil || len(c.add) == 0) &&
-		(c.addOptions == nil || len(c.addOptions) == 0) &&
-		!c.clear &&
-		!c.clearOption &&
-		(c.removeOptions == nil || len(c.removeOptions) == 0) &&
-		(c.remove == nil || len(c.remove) == 0) {
-		return errors.New("one of " +
-			"[-add-tags, -add-options, -remove-tags, -remove-options, -clear-tags, -clear-options]" +
-			" should be defined")
+	if c.output == "yaml" && len(c.add) == 0 {
+		return errors.New("-format yaml is requiring -add-tags")
 	}
 
-	if c.fieldName != "" && c.structName == "" {
-		return errors.New("-field is requiring -struct")
+	switch c.insertPosition {
+	case "", "start", "end":
+	default:
+		return fmt.Errorf("unknown insert position %q. Options: [start, end]", c.insertPosition)
 	}
 
 	return nil
 }
 
+// unquoteTag returns the given tag literal without its quotes, or an empty
+// string if there is no tag
+func unquoteTag(tag string) string {
+	if tag == "" {
+		return ""
+	}
+
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		return tag
+	}
+	return unquoted
+}
+
 func quote(tag string) string {
 	return "`" + tag + "`"
 }
@@ -912,6 +4382,241 @@ func split(line string) (int, error) {
 	return 0, fmt.Errorf("couldn't parse line: '%s'", line)
 }
 
+// diffLine is a line of a line based diff. The kind is ' ' for an unchanged
+// line, '-' for a removed and '+' for an added line.
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// diffHunk is a group of changes with the surrounding unchanged lines. The
+// line numbers are 1-based.
+type diffHunk struct {
+	aStart, aLines int
+	bStart, bLines int
+	lines          []diffLine
+}
+
+// diffLines returns the lines to be removed from a and added to b with the
+// Myers algorithm. The common prefix and suffix are trimmed first, as tags
+// usually change only a few lines of a file.
+func diffLines(a, b []string) []diffLine {
+	var prefix, suffix []diffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffLine{kind: ' ', text: a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append([]diffLine{{kind: ' ', text: a[len(a)-1]}}, suffix...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	n, m := len(a), len(b)
+	max := n + m
+	v := make([]int, 2*max+2)
+
+	// trace contains a copy of v for each edit distance d
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1] // down, an insertion
+			} else {
+				x = v[max+k-1] + 1 // right, a deletion
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+
+			v[max+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+
+		if done {
+			break
+		}
+	}
+
+	// backtrack the edits from the end
+	var middle []diffLine
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := v[max+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			middle = append(middle, diffLine{kind: ' ', text: a[x-1]})
+			x, y = x-1, y-1
+		}
+
+		if d > 0 {
+			if x == prevX {
+				middle = append(middle, diffLine{kind: '+', text: b[prevY]})
+			} else {
+				middle = append(middle, diffLine{kind: '-', text: a[prevX]})
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(middle)-1; i < j; i, j = i+1, j-1 {
+		middle[i], middle[j] = middle[j], middle[i]
+	}
+
+	lines := append(prefix, middle...)
+	return append(lines, suffix...)
+}
+
+// diffHunks groups the changes of the given diff into hunks with the given
+// number of unchanged lines around them. Changes closer than twice the
+// context are part of the same hunk.
+func diffHunks(lines []diffLine, context int) []diffHunk {
+	var hunks []diffHunk
+
+	// the line numbers of a and b before each diff line
+	aLine, bLine := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	aLine[0], bLine[0] = 1, 1
+	for i, l := range lines {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if l.kind != '+' {
+			aLine[i+1]++
+		}
+		if l.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		if lines[i].kind == ' ' {
+			continue
+		}
+
+		// extend the hunk as long as the next change is close enough
+		start, end := i, i+1
+		for j := end; j < len(lines); j++ {
+			if lines[j].kind == ' ' {
+				continue
+			}
+			if j-end > 2*context {
+				break
+			}
+			end = j + 1
+		}
+
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		to := end + context
+		if to > len(lines) {
+			to = len(lines)
+		}
+
+		hunks = append(hunks, diffHunk{
+			aStart: aLine[from],
+			aLines: aLine[to] - aLine[from],
+			bStart: bLine[from],
+			bLines: bLine[to] - bLine[from],
+			lines:  lines[from:to],
+		})
+
+		i = end - 1
+	}
+
+	return hunks
+}
+
+// diffStat returns the number of hunks and the added and removed lines
+// between the source and the output, in the form of "file: +2 -2, 1 hunk"
+func (c *config) diffStat(out []byte) string {
+	lines := diffLines(strings.Split(string(c.src), "\n"), strings.Split(string(out), "\n"))
+
+	added, removed := 0, 0
+	for _, l := range lines {
+		switch l.kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+
+	hunks := len(diffHunks(lines, 3))
+	unit := "hunks"
+	if hunks == 1 {
+		unit = "hunk"
+	}
+
+	return fmt.Sprintf("%s: +%d -%d, %d %s", c.file, added, removed, hunks, unit)
+}
+
+// unifiedDiff returns the changes between the source and the output as a
+// unified diff with three lines of context, i.e:
+//
+//	--- demo.go
+//	+++ demo.go
+//	@@ -3,4 +3,4 @@
+//	...
+//
+// The diff is empty if nothing changed.
+func (c *config) unifiedDiff(out []byte) string {
+	hunks := diffHunks(diffLines(splitLines(c.src), splitLines(out)), 3)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", c.file, c.file)
+	for _, h := range hunks {
+		// an empty range starts at the line before it
+		aStart, bStart := h.aStart, h.bStart
+		if h.aLines == 0 {
+			aStart--
+		}
+		if h.bLines == 0 {
+			bStart--
+		}
+
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aStart, h.aLines, bStart, h.bLines)
+		for _, l := range h.lines {
+			buf.WriteByte(l.kind)
+			buf.WriteString(l.text)
+			buf.WriteByte('\n')
+		}
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// splitLines returns the lines of the given source without the line breaks
+func splitLines(src []byte) []string {
+	if len(src) == 0 {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(string(src), "\n"), "\n")
+}
+
 // deref takes an expression, and removes all its leading "*" and "[]"
 // operator. Uuse case : if found expression is a "*t" or "[]t", we need to
 // check if "t" contains a struct expression.
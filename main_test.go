@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,8 +10,10 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 var update = flag.Bool("update", false, "update golden (.out) files")
@@ -41,6 +44,92 @@ func TestRewrite(t *testing.T) {
 				transform:  "snakecase",
 			},
 		},
+		{
+			file: "struct_add_preserve_underscores",
+			cfg: &config{
+				add:                 []string{"json"},
+				output:              "source",
+				structName:          "foo",
+				transform:           "snakecase",
+				preserveUnderscores: true,
+			},
+		},
+		{
+			file: "struct_add_initialisms",
+			cfg: &config{
+				add:         []string{"json"},
+				output:      "source",
+				structName:  "foo",
+				transform:   "snakecase",
+				initialisms: []string{"ACL", "ID", "URL", "HTTP", "API"},
+			},
+		},
+		{
+			file: "struct_add_nested_anonymous",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "struct_add_initialisms_leading_trailing",
+			cfg: &config{
+				add:         []string{"json"},
+				output:      "source",
+				structName:  "foo",
+				transform:   "snakecase",
+				initialisms: []string{"ID", "URL", "HTTP", "API"},
+			},
+		},
+		{
+			file: "struct_add_initialisms_common",
+			cfg: &config{
+				add:         []string{"json"},
+				output:      "source",
+				structName:  "foo",
+				transform:   "snakecase",
+				initialisms: []string{"ID", "URL", "HTTP", "API", "JSON"},
+			},
+		},
+		{
+			file: "struct_add_initialisms_lispcase",
+			cfg: &config{
+				add:         []string{"yaml"},
+				output:      "source",
+				structName:  "foo",
+				transform:   "lispcase",
+				initialisms: []string{"ID", "URL", "HTTP", "API", "JSON"},
+			},
+		},
+		{
+			file: "struct_add_pathological",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "json",
+				structName: "foo",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "struct_detect_collisions",
+			cfg: &config{
+				add:           []string{"json"},
+				output:        "json",
+				structName:    "foo",
+				transform:     "snakecase",
+				collisionKeys: []string{"json"},
+			},
+		},
+		{
+			file: "struct_detect_inconsistent_case",
+			cfg: &config{
+				output:               "json",
+				structName:           "foo",
+				inconsistentCaseKeys: []string{"json"},
+			},
+		},
 		{
 			file: "struct_add_existing",
 			cfg: &config{
@@ -91,727 +180,2938 @@ func TestRewrite(t *testing.T) {
 			},
 		},
 		{
-			file: "struct_remove",
+			file: "struct_format_index",
 			cfg: &config{
-				remove:     []string{"json"},
-				output:     "source",
-				structName: "foo",
+				add:         []string{"protobuf"},
+				output:      "source",
+				structName:  "foo",
+				transform:   "snakecase",
+				valueFormat: "{index}",
 			},
 		},
 		{
-			file: "struct_clear_tags",
+			file: "struct_format_by_key",
 			cfg: &config{
-				clear:      true,
+				add:        []string{"json", "db"},
 				output:     "source",
 				structName: "foo",
+				transform:  "snakecase",
+				valueFormatByKey: map[string]string{
+					"db": "column:{field}",
+				},
 			},
 		},
 		{
-			file: "struct_clear_options",
+			file: "struct_format_struct",
 			cfg: &config{
-				clearOption: true,
+				add:         []string{"db"},
 				output:      "source",
-				structName:  "foo",
+				all:         true,
+				transform:   "snakecase",
+				valueFormat: "{struct}.{field}",
 			},
 		},
 		{
-			file: "line_add",
+			file: "struct_inherit_embedded_tags",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4",
-				transform: "snakecase",
+				add:             []string{"json", "db"},
+				output:          "source",
+				structName:      "User",
+				transform:       "snakecase",
+				inheritEmbedded: true,
 			},
 		},
 		{
-			file: "line_add_override",
+			file: "struct_max_fields",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,5",
-				transform: "snakecase",
-				override:  true,
+				add:        []string{"json"},
+				output:     "json",
+				structName: "foo",
+				transform:  "snakecase",
+				maxFields:  2,
 			},
 		},
 		{
-			file: "line_add_override_column",
+			file: "struct_comment_name",
 			cfg: &config{
-				add:       []string{"json:MyBar:bar"},
-				output:    "source",
-				line:      "4,4",
-				transform: "snakecase",
-				override:  true,
+				add:          []string{"json"},
+				output:       "source",
+				structName:   "foo",
+				transform:    "snakecase",
+				commentNames: true,
 			},
 		},
 		{
-			file: "line_add_override_mixed_column_and_equal",
+			file: "struct_format_doc",
 			cfg: &config{
-				add:       []string{"json:MyBar:bar:foo=qux"},
-				output:    "source",
-				line:      "4,4",
-				transform: "snakecase",
-				override:  true,
+				add:        []string{"json", "description"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+				valueFormatByKey: map[string]string{
+					"description": "{doc}",
+				},
 			},
 		},
 		{
-			file: "line_add_override_multi_equal",
+			file: "struct_occurrence",
 			cfg: &config{
-				add:       []string{"json:MyBar=bar=foo"},
-				output:    "source",
-				line:      "4,4",
-				transform: "snakecase",
-				override:  true,
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				occurrence: 2,
+				transform:  "snakecase",
 			},
 		},
 		{
-			file: "line_add_override_multi_column",
+			file: "struct_add_empty_name",
 			cfg: &config{
-				add:       []string{"json:MyBar:bar:foo"},
-				output:    "source",
-				line:      "4,4",
-				transform: "snakecase",
-				override:  true,
+				add:        []string{"xml"},
+				addOptions: []string{"json=omitempty"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
 			},
 		},
 		{
-			file: "line_add_no_override",
+			file: "struct_infer_case",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,5",
-				transform: "snakecase",
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+				inferCase:  true,
 			},
 		},
 		{
-			file: "line_add_outside",
+			file: "struct_targets",
 			cfg: &config{
 				add:       []string{"json"},
 				output:    "source",
-				line:      "2,8",
+				targets:   []string{"foo.Name", "bar.Note", "qux"},
 				transform: "snakecase",
 			},
 		},
 		{
-			file: "line_add_outside_partial_start",
+			file: "struct_tag_spacing",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "2,5",
-				transform: "snakecase",
+				add:        []string{"yaml"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
 			},
 		},
 		{
-			file: "line_add_outside_partial_end",
+			file: "struct_minimal_diff_add_key",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "5,8",
-				transform: "snakecase",
+				add:         []string{"yaml"},
+				output:      "source",
+				structName:  "foo",
+				transform:   "snakecase",
+				minimalDiff: true,
 			},
 		},
 		{
-			file: "line_add_intersect_partial",
+			file: "struct_minimal_diff_add_key_start",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "5,11",
-				transform: "snakecase",
+				add:            []string{"yaml"},
+				output:         "source",
+				structName:     "foo",
+				transform:      "snakecase",
+				minimalDiff:    true,
+				insertPosition: "start",
 			},
 		},
 		{
-			file: "line_add_comment",
+			file: "struct_tag_spacing_minimal_diff",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "6,7",
-				transform: "snakecase",
+				add:         []string{"json"},
+				output:      "source",
+				structName:  "foo",
+				transform:   "snakecase",
+				minimalDiff: true,
 			},
 		},
 		{
-			file: "line_add_option",
+			file: "struct_minimal_diff",
 			cfg: &config{
-				addOptions: []string{"json=omitempty"},
-				output:     "source",
-				line:       "4,7",
+				add:         []string{"json"},
+				output:      "source",
+				structName:  "foo",
+				transform:   "snakecase",
+				minimalDiff: true,
 			},
 		},
 		{
-			file: "line_add_option_existing",
+			file: "mapping_yaml",
 			cfg: &config{
-				addOptions: []string{"json=omitempty"},
-				output:     "source",
-				line:       "6,8",
+				add:       []string{"json"},
+				output:    "yaml",
+				all:       true,
+				transform: "snakecase",
 			},
 		},
 		{
-			file: "line_add_multiple_option",
+			file: "struct_force",
 			cfg: &config{
-				addOptions: []string{"json=omitempty", "hcl=squash"},
-				add:        []string{"hcl"},
+				add:        []string{"json"},
 				output:     "source",
-				line:       "4,7",
+				structName: "foo",
 				transform:  "snakecase",
+				force:      true,
 			},
 		},
 		{
-			file: "line_add_option_with_equal",
+			file: "struct_skip_tag_values",
 			cfg: &config{
-				addOptions: []string{"validate=max=32"},
-				add:        []string{"validate"},
-				output:     "source",
-				line:       "4,7",
-				transform:  "snakecase",
+				add:           []string{"yaml"},
+				output:        "source",
+				structName:    "foo",
+				transform:     "snakecase",
+				skipTagValues: map[string]string{"json": "-"},
 			},
 		},
 		{
-			file: "line_remove",
+			file: "struct_format_embedded",
 			cfg: &config{
-				remove: []string{"json"},
-				output: "source",
-				line:   "5,7",
+				add:                 []string{"mapstructure"},
+				output:              "source",
+				structName:          "foo",
+				transform:           "snakecase",
+				valueFormat:         "{field}",
+				valueFormatEmbedded: ",squash",
 			},
 		},
 		{
-			file: "line_remove_option",
+			file: "struct_add_bom",
 			cfg: &config{
-				removeOptions: []string{"hcl=squash"},
-				output:        "source",
-				line:          "4,8",
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
 			},
 		},
 		{
-			file: "line_remove_options",
+			file: "struct_add_screamingsnake",
 			cfg: &config{
-				removeOptions: []string{"json=omitempty", "hcl=omitnested"},
-				output:        "source",
-				line:          "4,7",
+				add:        []string{"env", "db"},
+				output:     "source",
+				structName: "foo",
+				transform:  "screamingsnake",
+				valueFormatByKey: map[string]string{
+					"db": "column:{field}",
+				},
 			},
 		},
 		{
-			file: "line_remove_option_with_equal",
+			file: "struct_add_allowed_chars",
 			cfg: &config{
-				removeOptions: []string{"validate=max=32"},
-				output:        "source",
-				line:          "4,7",
+				add:          []string{"json"},
+				output:       "source",
+				structName:   "foo",
+				transform:    "snakecase",
+				allowedChars: regexp.MustCompile(`[a-z0-9_]`),
 			},
 		},
 		{
-			file: "line_multiple_add",
+			file: "all_field",
 			cfg: &config{
 				add:       []string{"json"},
 				output:    "source",
-				line:      "5,6",
-				transform: "camelcase",
+				all:       true,
+				fieldName: "ID",
+				transform: "snakecase",
 			},
 		},
 		{
-			file: "line_lispcase_add",
+			file: "struct_sort_keep_options",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,6",
-				transform: "lispcase",
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+				sort:       true,
 			},
 		},
 		{
-			file: "line_camelcase_add",
+			file: "struct_sort_order",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,5",
-				transform: "camelcase",
+				add:        []string{"yaml"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+				sortOrder:  []string{"json", "yaml", "db"},
 			},
 		},
 		{
-			file: "line_camelcase_add_embedded",
+			file: "struct_consistent_order",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,6",
-				transform: "camelcase",
+				output:          "source",
+				structName:      "foo",
+				consistentOrder: true,
 			},
 		},
 		{
-			file: "line_value_add",
+			file: "struct_add_explicit_value",
 			cfg: &config{
-				add:    []string{"json:foo"},
-				output: "source",
-				line:   "4,6",
+				add:        []string{"json:custom", "xml"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
 			},
 		},
 		{
-			file: "offset_add",
+			file: "struct_test_file",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				offset:    32,
-				transform: "snakecase",
+				add:        []string{"json"},
+				output:     "source",
+				structName: "testCase",
+				transform:  "snakecase",
 			},
 		},
 		{
-			file: "offset_add_composite",
+			file: "struct_option_separators",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				offset:    40,
-				transform: "snakecase",
+				addOptions:       []string{"ent=nillable", "json=omitempty"},
+				optionSeparators: map[string]string{"ent": "|"},
+				output:           "source",
+				structName:       "foo",
 			},
 		},
 		{
-			file: "offset_add_duplicate",
+			file: "struct_remove",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				offset:    209,
-				transform: "snakecase",
-			},
-		},
-		{
-			file: "offset_add_literal_in",
-			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				offset:    46,
-				transform: "snakecase",
-			},
-		},
-		{
-			file: "offset_add_literal_out",
-			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				offset:    32,
-				transform: "snakecase",
+				remove:     []string{"json"},
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "errors",
+			file: "struct_canonical",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,7",
-				transform: "snakecase",
+				canonical:  true,
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "line_pascalcase_add",
+			file: "struct_remove_only_tag",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,5",
-				transform: "pascalcase",
+				remove:     []string{"json"},
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "line_pascalcase_add_embedded",
+			file: "struct_clear_tags",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,6",
-				transform: "pascalcase",
+				clear:      true,
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "not_formatted",
+			file: "struct_clear_tags_keys",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "3,4",
-				transform: "snakecase",
+				clearKeys:  []string{"json", "xml"},
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "skip_private",
+			file: "struct_clear_tags_comment",
 			cfg: &config{
-				add:                  []string{"json"},
-				output:               "source",
-				structName:           "foo",
-				transform:            "snakecase",
-				skipUnexportedFields: true,
+				clear:      true,
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "skip_private_multiple_names",
+			file: "struct_rename_tags",
 			cfg: &config{
-				add:                  []string{"json"},
-				output:               "source",
-				structName:           "foo",
-				transform:            "snakecase",
-				skipUnexportedFields: true,
+				rename:     []tagRename{{from: "bson", to: "json"}},
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "skip_embedded",
+			file: "struct_rename_tags_chained",
 			cfg: &config{
-				add:                  []string{"json"},
-				output:               "source",
-				structName:           "StationCreated",
-				transform:            "snakecase",
-				skipUnexportedFields: true,
+				rename:     []tagRename{{from: "a", to: "b"}, {from: "b", to: "c"}},
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "all_structs",
+			file: "struct_remove_ignored",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				all:       true,
-				transform: "snakecase",
+				removeIgnored: []string{"json"},
+				output:        "source",
+				structName:    "foo",
 			},
 		},
 		{
-			file: "line_titlecase_add",
+			file: "struct_remove_ignored_add",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,6",
-				transform: "titlecase",
+				removeIgnored: []string{"json"},
+				add:           []string{"json"},
+				output:        "source",
+				structName:    "foo",
+				transform:     "snakecase",
 			},
 		},
 		{
-			file: "line_titlecase_add_embedded",
+			file: "struct_dedupe_options",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				line:      "4,6",
-				transform: "titlecase",
+				addOptions: []string{"json=omitempty"},
+				dedupe:     true,
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "field_add",
+			file: "struct_atomic",
 			cfg: &config{
 				add:        []string{"json"},
+				atomic:     true,
 				output:     "source",
 				structName: "foo",
-				fieldName:  "bar",
 				transform:  "snakecase",
 			},
 		},
 		{
-			file: "field_add_same_line",
+			file: "struct_atomic_json",
 			cfg: &config{
 				add:        []string{"json"},
-				output:     "source",
+				atomic:     true,
+				output:     "json",
 				structName: "foo",
-				fieldName:  "qux",
 				transform:  "snakecase",
 			},
 		},
 		{
-			file: "field_add_existing",
+			file: "struct_keep_tags",
 			cfg: &config{
-				add:        []string{"json"},
+				keep:       []string{"json", "yaml"},
 				output:     "source",
 				structName: "foo",
-				fieldName:  "bar",
-				transform:  "snakecase",
 			},
 		},
 		{
-			file: "field_clear_tags",
+			file: "struct_remove_option_if_last",
 			cfg: &config{
-				clear:      true,
-				output:     "source",
-				structName: "foo",
-				fieldName:  "bar",
+				removeOptions:      []string{"json=omitempty"},
+				removeOptionIfLast: true,
+				output:             "source",
+				structName:         "foo",
 			},
 		},
 		{
-			file: "field_clear_options",
+			file: "struct_remove_options_keep_name",
 			cfg: &config{
-				clearOption: true,
-				output:      "source",
-				structName:  "foo",
-				fieldName:   "bar",
+				removeOptions: []string{"json=omitempty"},
+				output:        "source",
+				structName:    "foo",
 			},
 		},
 		{
-			file: "field_remove",
+			file: "struct_remove_options_prune",
 			cfg: &config{
-				remove:     []string{"json"},
-				output:     "source",
-				structName: "foo",
-				fieldName:  "bar",
+				removeOptions: []string{"json=omitempty"},
+				pruneEmpty:    true,
+				output:        "source",
+				structName:    "foo",
 			},
 		},
 		{
-			file: "offset_anonymous_struct",
+			file: "struct_clear_tags_embedded",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				offset:    45,
-				transform: "camelcase",
+				clear:        true,
+				embeddedOnly: true,
+				output:       "source",
+				structName:   "foo",
 			},
 		},
 		{
-			file: "offset_star_struct",
+			file: "struct_clear_options",
 			cfg: &config{
-				add:       []string{"json"},
-				output:    "source",
-				offset:    35,
-				transform: "camelcase",
+				clearOption: true,
+				output:      "source",
+				structName:  "foo",
 			},
 		},
 		{
-			file: "offset_array_struct",
+			file: "line_add",
 			cfg: &config{
 				add:       []string{"json"},
 				output:    "source",
-				offset:    35,
-				transform: "camelcase",
+				line:      "4",
+				transform: "snakecase",
 			},
 		},
-	}
-
-	for _, ts := range test {
-		t.Run(ts.file, func(t *testing.T) {
-			ts.cfg.file = filepath.Join(fixtureDir, fmt.Sprintf("%s.input", ts.file))
-
-			node, err := ts.cfg.parse()
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			start, end, err := ts.cfg.findSelection(node)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			rewrittenNode, err := ts.cfg.rewrite(node, start, end)
-			if err != nil {
-				if _, ok := err.(*rewriteErrors); !ok {
-					t.Fatal(err)
-				}
-			}
-
-			out, err := ts.cfg.format(rewrittenNode, err)
-			if err != nil {
-				t.Fatal(err)
-			}
-			got := []byte(out)
-
-			// update golden file if necessary
-			golden := filepath.Join(fixtureDir, fmt.Sprintf("%s.golden", ts.file))
-			if *update {
-				err := ioutil.WriteFile(golden, got, 0644)
-				if err != nil {
-					t.Error(err)
-				}
-				return
-			}
-
-			// get golden file
-			want, err := ioutil.ReadFile(golden)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			var from []byte
-			if ts.cfg.modified != nil {
-				from, err = ioutil.ReadAll(ts.cfg.modified)
-			} else {
-				from, err = ioutil.ReadFile(ts.cfg.file)
-			}
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			// compare
-			if !bytes.Equal(got, want) {
-				t.Errorf("case %s\ngot:\n====\n\n%s\nwant:\n=====\n\n%s\nfrom:\n=====\n\n%s\n",
-					ts.file, got, want, from)
-			}
-		})
-	}
-}
-
-func TestJSON(t *testing.T) {
-	test := []struct {
-		cfg  *config
-		file string
-		err  error
-	}{
 		{
-			file: "json_single",
+			file: "line_add_multiple_ranges",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "5",
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,5;10,11",
+				transform: "snakecase",
 			},
 		},
 		{
-			file: "json_full",
+			file: "struct_add_options_missing_key",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "4,6",
+				addOptions: []string{"json=omitempty", "xml=attr"},
+				output:     "source",
+				structName: "foo",
 			},
 		},
 		{
-			file: "json_intersection",
+			file: "struct_add_options_create",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "5,16",
+				addOptions:       []string{"json=omitempty", "xml=attr"},
+				output:           "source",
+				structName:       "foo",
+				createOptionTags: true,
 			},
 		},
 		{
-			// both small & end range larger than file
-			file: "json_single",
+			file: "line_add_override",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "30,32", // invalid selection
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,5",
+				transform: "snakecase",
+				override:  true,
 			},
-			err: errors.New("line selection is invalid"),
 		},
 		{
-			// end range larger than file
-			file: "json_single",
+			file: "line_add_override_column",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "4,50", // invalid selection
+				add:       []string{"json:MyBar:bar"},
+				output:    "source",
+				line:      "4,4",
+				transform: "snakecase",
+				override:  true,
 			},
-			err: errors.New("line selection is invalid"),
 		},
 		{
-			file: "json_errors",
+			file: "line_add_override_mixed_column_and_equal",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "4,7",
+				add:       []string{"json:MyBar:bar:foo=qux"},
+				output:    "source",
+				line:      "4,4",
+				transform: "snakecase",
+				override:  true,
 			},
 		},
 		{
-			file: "json_not_formatted",
+			file: "line_add_override_multi_equal",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "3,4",
+				add:       []string{"json:MyBar=bar=foo"},
+				output:    "source",
+				line:      "4,4",
+				transform: "snakecase",
+				override:  true,
 			},
 		},
 		{
-			file: "json_not_formatted_2",
+			file: "line_add_override_multi_column",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "3,3",
+				add:       []string{"json:MyBar:bar:foo"},
+				output:    "source",
+				line:      "4,4",
+				transform: "snakecase",
+				override:  true,
 			},
 		},
 		{
-			file: "json_not_formatted_3",
+			file: "line_add_insert_start",
 			cfg: &config{
-				add:    []string{"json"},
-				offset: 23,
+				add:            []string{"json", "yaml"},
+				output:         "source",
+				line:           "4,5",
+				transform:      "snakecase",
+				insertPosition: "start",
 			},
 		},
 		{
-			file: "json_not_formatted_4",
+			file: "line_add_no_override",
 			cfg: &config{
-				add:    []string{"json"},
-				offset: 51,
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,5",
+				transform: "snakecase",
 			},
 		},
 		{
-			file: "json_not_formatted_5",
+			file: "line_add_outside",
 			cfg: &config{
-				add:    []string{"json"},
-				offset: 29,
+				add:       []string{"json"},
+				output:    "source",
+				line:      "2,8",
+				transform: "snakecase",
 			},
 		},
 		{
-			file: "json_not_formatted_6",
+			file: "line_add_outside_partial_start",
 			cfg: &config{
-				add:  []string{"json"},
-				line: "2,54",
+				add:       []string{"json"},
+				output:    "source",
+				line:      "2,5",
+				transform: "snakecase",
 			},
 		},
 		{
-			file: "json_all_structs",
+			file: "line_add_outside_partial_end",
 			cfg: &config{
-				add: []string{"json"},
-				all: true,
+				add:       []string{"json"},
+				output:    "source",
+				line:      "5,8",
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "line_add_intersect_partial",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "5,11",
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "line_add_comment",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "6,7",
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "lines_add",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				lines:     "4,6,10",
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "text_edits",
+			cfg: &config{
+				add:       []string{"json"},
+				remove:    []string{"xml"},
+				output:    "text-edits",
+				line:      "4,7",
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "line_add_option",
+			cfg: &config{
+				addOptions: []string{"json=omitempty"},
+				output:     "source",
+				line:       "4,7",
+			},
+		},
+		{
+			file: "line_add_option_existing",
+			cfg: &config{
+				addOptions: []string{"json=omitempty"},
+				output:     "source",
+				line:       "6,8",
+			},
+		},
+		{
+			file: "line_add_multiple_option",
+			cfg: &config{
+				addOptions: []string{"json=omitempty", "hcl=squash"},
+				add:        []string{"hcl"},
+				output:     "source",
+				line:       "4,7",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "line_add_option_with_equal",
+			cfg: &config{
+				addOptions: []string{"validate=max=32"},
+				add:        []string{"validate"},
+				output:     "source",
+				line:       "4,7",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "line_option_aliases",
+			cfg: &config{
+				optionAliases: map[string]string{"not null": "notNull"},
+				output:        "source",
+				line:          "4,6",
+			},
+		},
+		{
+			file: "line_remove",
+			cfg: &config{
+				remove: []string{"json"},
+				output: "source",
+				line:   "5,7",
+			},
+		},
+		{
+			file: "line_remove_option",
+			cfg: &config{
+				removeOptions: []string{"hcl=squash"},
+				output:        "source",
+				line:          "4,8",
+			},
+		},
+		{
+			file: "line_remove_options",
+			cfg: &config{
+				removeOptions: []string{"json=omitempty", "hcl=omitnested"},
+				output:        "source",
+				line:          "4,7",
+			},
+		},
+		{
+			file: "line_remove_option_with_equal",
+			cfg: &config{
+				removeOptions: []string{"validate=max=32"},
+				output:        "source",
+				line:          "4,7",
+			},
+		},
+		{
+			file: "line_multiple_add",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "5,6",
+				transform: "camelcase",
+			},
+		},
+		{
+			file: "line_lispcase_add",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,6",
+				transform: "lispcase",
+			},
+		},
+		{
+			file: "line_camelcase_add",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,5",
+				transform: "camelcase",
+			},
+		},
+		{
+			file: "line_camelcase_add_embedded",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,6",
+				transform: "camelcase",
+			},
+		},
+		{
+			file: "line_gojson_add",
+			cfg: &config{
+				add:         []string{"json"},
+				output:      "source",
+				line:        "4,7",
+				transform:   "gojson",
+				valueFormat: "field_name={field}",
+			},
+		},
+		{
+			file: "line_value_add",
+			cfg: &config{
+				add:    []string{"json:foo"},
+				output: "source",
+				line:   "4,6",
+			},
+		},
+		{
+			file: "offset_add",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    32,
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "offset_nested_struct",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    83,
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "offset_add_composite",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    40,
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "offset_add_duplicate",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    209,
+				transform: "snakecase",
 			},
 		},
+		{
+			file: "offset_add_literal_in",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    46,
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "offset_add_literal_out",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    32,
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "errors",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,7",
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "line_pascalcase_add",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,5",
+				transform: "pascalcase",
+			},
+		},
+		{
+			file: "line_pascalcase_add_embedded",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,6",
+				transform: "pascalcase",
+			},
+		},
+		{
+			file: "not_formatted",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "3,4",
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "skip_private",
+			cfg: &config{
+				add:                  []string{"json"},
+				output:               "source",
+				structName:           "foo",
+				transform:            "snakecase",
+				skipUnexportedFields: true,
+			},
+		},
+		{
+			file: "skip_private_multiple_names",
+			cfg: &config{
+				add:                  []string{"json"},
+				output:               "source",
+				structName:           "foo",
+				transform:            "snakecase",
+				skipUnexportedFields: true,
+			},
+		},
+		{
+			file: "skip_interfaces",
+			cfg: &config{
+				add:                 []string{"json"},
+				output:              "source",
+				structName:          "foo",
+				transform:           "snakecase",
+				skipInterfaceFields: true,
+			},
+		},
+		{
+			file: "skip_interfaces_imported",
+			cfg: &config{
+				add:                 []string{"json"},
+				output:              "source",
+				structName:          "foo",
+				transform:           "snakecase",
+				skipInterfaceFields: true,
+			},
+		},
+		{
+			file: "skip_fields",
+			cfg: &config{
+				add:                  []string{"json"},
+				output:               "source",
+				structName:           "foo",
+				transform:            "snakecase",
+				skipUnexportedFields: true,
+				skipFields:           regexp.MustCompile("^XXX_"),
+			},
+		},
+		{
+			file: "skip_blank_fields",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "skip_embedded",
+			cfg: &config{
+				add:                  []string{"json"},
+				output:               "source",
+				structName:           "StationCreated",
+				transform:            "snakecase",
+				skipUnexportedFields: true,
+			},
+		},
+		{
+			file: "struct_add_embedded_selector",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "all_structs",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				all:       true,
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "struct_comment",
+			cfg: &config{
+				add:           []string{"json"},
+				output:        "source",
+				structComment: "@entity",
+				transform:     "snakecase",
+			},
+		},
+		{
+			file: "struct_regex",
+			cfg: &config{
+				add:         []string{"json"},
+				output:      "source",
+				structRegex: regexp.MustCompile("DTO$"),
+				transform:   "snakecase",
+			},
+		},
+		{
+			file: "struct_regex_field",
+			cfg: &config{
+				add:         []string{"json"},
+				output:      "source",
+				structRegex: regexp.MustCompile("DTO$"),
+				fieldName:   "Name",
+				transform:   "snakecase",
+			},
+		},
+		{
+			file: "diff",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "diff",
+				structName: "foo",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "struct_implements",
+			cfg: &config{
+				add:              []string{"json"},
+				output:           "source",
+				structImplements: "IsEntity",
+				transform:        "snakecase",
+			},
+		},
+		{
+			file: "json_per_struct",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "json-per-struct",
+				all:       true,
+				transform: "snakecase",
+			},
+		},
+		{
+			file: "line_titlecase_add",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,6",
+				transform: "titlecase",
+			},
+		},
+		{
+			file: "line_titlecase_add_embedded",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				line:      "4,6",
+				transform: "titlecase",
+			},
+		},
+		{
+			file: "struct_titlecase_digits",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "titlecase",
+			},
+		},
+		{
+			file: "struct_camelcase_leading_acronym",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "camelcase",
+			},
+		},
+		{
+			file: "struct_camelcase_digits",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "camelcase",
+			},
+		},
+		{
+			file: "struct_line_add",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				line:       "5,12",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "field_add",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				fieldName:  "bar",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "field_add_same_line",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				fieldName:  "qux",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "field_add_same_line_neighbor",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				fieldName:  "qux",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "field_add_existing",
+			cfg: &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				fieldName:  "bar",
+				transform:  "snakecase",
+			},
+		},
+		{
+			file: "field_clear_tags",
+			cfg: &config{
+				clear:      true,
+				output:     "source",
+				structName: "foo",
+				fieldName:  "bar",
+			},
+		},
+		{
+			file: "field_clear_options",
+			cfg: &config{
+				clearOption: true,
+				output:      "source",
+				structName:  "foo",
+				fieldName:   "bar",
+			},
+		},
+		{
+			file: "field_remove",
+			cfg: &config{
+				remove:     []string{"json"},
+				output:     "source",
+				structName: "foo",
+				fieldName:  "bar",
+			},
+		},
+		{
+			file: "offset_anonymous_struct",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    45,
+				transform: "camelcase",
+			},
+		},
+		{
+			file: "offset_star_struct",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    35,
+				transform: "camelcase",
+			},
+		},
+		{
+			file: "offset_array_struct",
+			cfg: &config{
+				add:       []string{"json"},
+				output:    "source",
+				offset:    35,
+				transform: "camelcase",
+			},
+		},
+	}
+
+	for _, ts := range test {
+		t.Run(ts.file, func(t *testing.T) {
+			ts.cfg.file = filepath.Join(fixtureDir, fmt.Sprintf("%s.input", ts.file))
+
+			node, err := ts.cfg.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start, end, err := ts.cfg.findSelection(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rewrittenNode, err := ts.cfg.rewrite(node, start, end)
+			if err != nil {
+				if _, ok := err.(*rewriteErrors); !ok {
+					t.Fatal(err)
+				}
+			}
+
+			out, err := ts.cfg.format(rewrittenNode, err)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []byte(out)
+
+			// update golden file if necessary
+			golden := filepath.Join(fixtureDir, fmt.Sprintf("%s.golden", ts.file))
+			if *update {
+				err := ioutil.WriteFile(golden, got, 0644)
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+
+			// get golden file
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var from []byte
+			if ts.cfg.modified != nil {
+				from, err = ioutil.ReadAll(ts.cfg.modified)
+			} else {
+				from, err = ioutil.ReadFile(ts.cfg.file)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// compare
+			if !bytes.Equal(got, want) {
+				t.Errorf("case %s\ngot:\n====\n\n%s\nwant:\n=====\n\n%s\nfrom:\n=====\n\n%s\n",
+					ts.file, got, want, from)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	test := []struct {
+		cfg  *config
+		file string
+		err  error
+	}{
+		{
+			file: "json_single",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "5",
+			},
+		},
+		{
+			file: "json_full",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "4,6",
+			},
+		},
+		{
+			file: "json_intersection",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "5,16",
+			},
+		},
+		{
+			// both small & end range larger than file
+			file: "json_single",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "30,32", // invalid selection
+			},
+			err: errors.New("line selection is invalid"),
+		},
+		{
+			// end range larger than file
+			file: "json_single",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "4,50", // invalid selection
+			},
+			err: errors.New("line selection is invalid"),
+		},
+		{
+			file: "json_errors",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "4,7",
+			},
+		},
+		{
+			file: "json_errors_tag",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "4,6",
+			},
+		},
+		{
+			file: "json_not_formatted",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "3,4",
+			},
+		},
+		{
+			file: "json_not_formatted_2",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "3,3",
+			},
+		},
+		{
+			file: "json_not_formatted_3",
+			cfg: &config{
+				add:    []string{"json"},
+				offset: 23,
+			},
+		},
+		{
+			file: "json_not_formatted_4",
+			cfg: &config{
+				add:    []string{"json"},
+				offset: 51,
+			},
+		},
+		{
+			file: "json_not_formatted_5",
+			cfg: &config{
+				add:    []string{"json"},
+				offset: 29,
+			},
+		},
+		{
+			file: "json_not_formatted_6",
+			cfg: &config{
+				add:  []string{"json"},
+				line: "2,54",
+			},
+		},
+		{
+			file: "json_all_structs",
+			cfg: &config{
+				add: []string{"json"},
+				all: true,
+			},
+		},
+	}
+
+	for _, ts := range test {
+		t.Run(ts.file, func(t *testing.T) {
+			ts.cfg.file = filepath.Join(fixtureDir, fmt.Sprintf("%s.input", ts.file))
+			// these are explicit and shouldn't be changed for this particular
+			// main test
+			ts.cfg.output = "json"
+			ts.cfg.transform = "camelcase"
+
+			node, err := ts.cfg.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start, end, err := ts.cfg.findSelection(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rewrittenNode, err := ts.cfg.rewrite(node, start, end)
+			if err != nil {
+				if _, ok := err.(*rewriteErrors); !ok {
+					t.Fatal(err)
+				}
+			}
+
+			out, err := ts.cfg.format(rewrittenNode, err)
+			if !reflect.DeepEqual(err, ts.err) {
+				t.Logf("want: %v", ts.err)
+				t.Logf("got: %v", err)
+				t.Fatalf("unexpected error")
+			}
+
+			if ts.err != nil {
+				return
+			}
+
+			got := []byte(out)
+
+			// update golden file if necessary
+			golden := filepath.Join(fixtureDir, fmt.Sprintf("%s.golden", ts.file))
+			if *update {
+				err := ioutil.WriteFile(golden, got, 0644)
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+
+			// get golden file
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			from, err := ioutil.ReadFile(ts.cfg.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// compare
+			if !bytes.Equal(got, want) {
+				t.Errorf("case %s\ngot:\n====\n\n%s\nwant:\n=====\n\n%s\nfrom:\n=====\n\n%s\n",
+					ts.file, got, want, from)
+			}
+		})
+	}
+}
+
+func TestModifiedRewrite(t *testing.T) {
+	cfg := &config{
+		add:        []string{"json"},
+		output:     "source",
+		structName: "foo",
+		transform:  "snakecase",
+		file:       "struct_add_modified",
+		modified: strings.NewReader(`struct_add_modified
+55
+package foo
+
+type foo struct {
+	bar string
+	t   bool
+}
+`),
+	}
+
+	node, err := cfg.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, end, err := cfg.findSelection(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrittenNode, err := cfg.rewrite(node, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cfg.format(rewrittenNode, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join(fixtureDir, "struct_add.golden")
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compare
+	if !bytes.Equal([]byte(got), want) {
+		t.Errorf("got:\n====\n%s\nwant:\n====\n%s\n", got, want)
+	}
+}
+
+func TestModifiedFileMissing(t *testing.T) {
+	cfg := &config{
+		add:        []string{"json"},
+		output:     "source",
+		structName: "foo",
+		transform:  "snakecase",
+		file:       "struct_add_modified",
+		modified: strings.NewReader(`file_that_doesnt_exist
+55
+package foo
+
+type foo struct {
+	bar string
+	t   bool
+}
+`),
+	}
+
+	_, err := cfg.parse()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestFormatNameEmbedded(t *testing.T) {
+	cfg := &config{
+		valueFormat:         "{field}",
+		valueFormatByKey:    map[string]string{"db": "column:{field}"},
+		valueFormatEmbedded: "{field},squash",
+	}
+
+	tests := []struct {
+		key   string
+		field fieldInfo
+		want  string
+	}{
+		{key: "json", field: fieldInfo{name: "Name"}, want: "name"},
+		{key: "db", field: fieldInfo{name: "Name"}, want: "column:name"},
+		{key: "json", field: fieldInfo{name: "Base", embedded: true}, want: "base,squash"},
+		{key: "db", field: fieldInfo{name: "Base", embedded: true}, want: "base,squash"},
+	}
+
+	for _, tt := range tests {
+		got, err := cfg.formatName(tt.key, strings.ToLower(tt.field.name), tt.field)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("%s tag of %s: got %q, want %q", tt.key, tt.field.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnvPlaceholder(t *testing.T) {
+	t.Setenv("GOMODIFYTAGS_BUILD_VERSION", "1.2.3")
+
+	cfg := &config{
+		add:         []string{"version"},
+		output:      "source",
+		structName:  "foo",
+		transform:   "snakecase",
+		valueFormat: "{field}@{env:GOMODIFYTAGS_BUILD_VERSION}",
+		file:        filepath.Join(fixtureDir, "struct_format_env.input"),
+	}
+
+	node, err := cfg.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, end, err := cfg.findSelection(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrittenNode, err := cfg.rewrite(node, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cfg.format(rewrittenNode, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join(fixtureDir, "struct_format_env.golden")
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte(got), want) {
+		t.Errorf("got:\n====\n%s\nwant:\n====\n%s\n", got, want)
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		cfg.valueFormat = "{env:GOMODIFYTAGS_MISSING}"
+
+		node, err := cfg.parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = cfg.rewrite(node, start, end)
+		if err == nil {
+			t.Fatal("expected error for an unset environment variable")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+		flag.CommandLine = flag.NewFlagSet("gomodifytags", flag.ContinueOnError)
+		flag.CommandLine.SetOutput(ioutil.Discard)
+
+		fc, err := parseConfig([]string{"-file", cfg.file, "-no-env"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !fc.disableEnv {
+			t.Fatal("-no-env should disable the {env:NAME} placeholder")
+		}
+
+		cfg.valueFormat = "{env:GOMODIFYTAGS_BUILD_VERSION}"
+		cfg.disableEnv = fc.disableEnv
+
+		got, err := cfg.formatValue(cfg.valueFormat, "bar", fieldInfo{name: "bar", index: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != cfg.valueFormat {
+			t.Errorf("got %q, want the placeholder untouched", got)
+		}
+	})
+
+	t.Run("doc", func(t *testing.T) {
+		cfg := &config{
+			add:         []string{"description"},
+			output:      "source",
+			all:         true,
+			transform:   "snakecase",
+			valueFormat: "{doc}",
+			file:        stdinFilename,
+			stdin: strings.NewReader("package foo\n\ntype foo struct {\n" +
+				"\t// {env:GOMODIFYTAGS_BUILD_VERSION}\n\tName string\n}\n"),
+		}
+
+		var out bytes.Buffer
+		if err := cfg.run(&out); err != nil {
+			t.Fatal(err)
+		}
+
+		// the doc comment isn't a format, its placeholder is left as it is
+		want := "Name string `description:\"{env:GOMODIFYTAGS_BUILD_VERSION}\"`"
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+		}
+	})
+}
+
+func TestReportMismatches(t *testing.T) {
+	cfg := &config{
+		add:              []string{"json"},
+		output:           "source",
+		structName:       "foo",
+		transform:        "snakecase",
+		reportMismatches: true,
+		file:             filepath.Join(fixtureDir, "report_mismatches.input"),
+	}
+
+	node, err := cfg.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, end, err := cfg.findSelection(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrittenNode, errs := cfg.rewrite(node, start, end)
+	rwErrs, ok := errs.(*rewriteErrors)
+	if !ok {
+		t.Fatalf("expected rewrite errors, got: %v", errs)
+	}
+
+	want := []string{
+		cfg.file + `:5:2:field Email: json tag name "e_mail" doesn't match "email"`,
+	}
+
+	var got []string
+	for _, err := range rwErrs.errs {
+		got = append(got, err.Error())
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+
+	// the source should be left untouched
+	out, err := cfg.format(rewrittenNode, errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, err := ioutil.ReadFile(cfg.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out != string(from) {
+		t.Errorf("source is modified:\n%s", out)
+	}
+
+	t.Run("json", func(t *testing.T) {
+		cfg := &config{
+			add:              []string{"json"},
+			output:           "json",
+			structName:       "foo",
+			transform:        "snakecase",
+			reportMismatches: true,
+			file:             filepath.Join(fixtureDir, "report_mismatches.input"),
+		}
+
+		var buf bytes.Buffer
+		if err := cfg.run(&buf); err != errMismatches {
+			t.Fatalf("got error %v, want %v", err, errMismatches)
+		}
+
+		var report struct {
+			Errors []string `json:"errors"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(report.Errors, want) {
+			t.Errorf("got:\n%q\nwant:\n%q", report.Errors, want)
+		}
+	})
+}
+
+func TestDetectReports(t *testing.T) {
+	test := []struct {
+		name string
+		cfg  *config
+		want string
+	}{
+		{
+			name: "collisions",
+			cfg: &config{
+				add:           []string{"json"},
+				output:        "source",
+				structName:    "foo",
+				transform:     "snakecase",
+				collisionKeys: []string{"json"},
+				file:          filepath.Join(fixtureDir, "struct_detect_collisions.input"),
+			},
+			want: filepath.Join(fixtureDir, "struct_detect_collisions.input") +
+				`:5:2:json tag name "id" of field UserID collides with field ID`,
+		},
+		{
+			name: "inconsistent_case",
+			cfg: &config{
+				output:               "source",
+				structName:           "foo",
+				inconsistentCaseKeys: []string{"json"},
+				file:                 filepath.Join(fixtureDir, "struct_detect_inconsistent_case.input"),
+			},
+			want: filepath.Join(fixtureDir, "struct_detect_inconsistent_case.input") +
+				`:5:2:json tag name "firstName" of field FirstName is camelcase instead of snakecase`,
+		},
+	}
+
+	for _, ts := range test {
+		t.Run(ts.name, func(t *testing.T) {
+			// the reports have to fail the run, not only the json formats
+			err := ts.cfg.run(ioutil.Discard)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if strings.TrimSpace(err.Error()) != ts.want {
+				t.Errorf("got error:\n%s\nwant:\n%s", err, ts.want)
+			}
+		})
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	for _, output := range []string{"source", "diff", "text-edits", "json"} {
+		t.Run(output, func(t *testing.T) {
+			cfg := &config{
+				add:        []string{"json"},
+				atomic:     true,
+				output:     output,
+				structName: "foo",
+				transform:  "snakecase",
+				file:       filepath.Join(fixtureDir, "struct_atomic.input"),
+			}
+
+			// the aborted run fails in every format, the json formats
+			// include the errors in the output
+			err := cfg.run(ioutil.Discard)
+			if output == "json" {
+				if err != errReported {
+					t.Fatalf("got error %v, want %v", err, errReported)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), "`json:email`") {
+				t.Fatalf("expected an error for the invalid tag, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestMaxFields(t *testing.T) {
+	for _, output := range []string{"source", "diff", "json"} {
+		t.Run(output, func(t *testing.T) {
+			cfg := &config{
+				add:        []string{"json"},
+				output:     output,
+				structName: "foo",
+				transform:  "snakecase",
+				maxFields:  2,
+				file:       filepath.Join(fixtureDir, "struct_max_fields.input"),
+			}
+
+			// reaching the limit fails the run, not only with -format json
+			err := cfg.run(ioutil.Discard)
+			if output == "json" {
+				if err != errReported {
+					t.Fatalf("got error %v, want %v", err, errReported)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), "-max-fields is reached: 2 more fields are not modified") {
+				t.Fatalf("expected the -max-fields error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestEditor(t *testing.T) {
+	src := "package foo\n\ntype foo struct {\n\tbar string\n\tBaz int `json:\"baz\"`\n}\n"
+	req := editorRequest{
+		File:      "unsaved.go",
+		Source:    src,
+		Selection: editorSelection{Struct: "foo"},
+		Operations: editorOperations{
+			AddTags: []string{"json", "xml"},
+		},
+	}
+
+	in, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runEditor(bytes.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp editorResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := editorResponse{
+		Edits: []textEdit{
+			{
+				Range: editRange{
+					Start: editPosition{Line: 3, Character: 11},
+					End:   editPosition{Line: 3, Character: 11},
+				},
+				NewText: " `json:\"bar\" xml:\"bar\"`",
+			},
+			{
+				Range: editRange{
+					Start: editPosition{Line: 4, Character: 9},
+					End:   editPosition{Line: 4, Character: 21},
+				},
+				NewText: "`json:\"baz\" xml:\"baz\"`",
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("got:\n%+v\nwant:\n%+v", resp, want)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		req.Selection = editorSelection{Struct: "missing"}
+
+		in, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := runEditor(bytes.NewReader(in), &out); err != nil {
+			t.Fatal(err)
+		}
+
+		want := `{"edits":[],"errors":["struct name does not exist"]}` + "\n"
+		if out.String() != want {
+			t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+		}
+	})
+}
+
+func TestJSONErrors(t *testing.T) {
+	cfg := &config{
+		add:        []string{"json"},
+		output:     "json",
+		line:       "100",
+		transform:  "snakecase",
+		jsonErrors: true,
+		file:       filepath.Join(fixtureDir, "struct_add.input"),
+	}
+
+	var out bytes.Buffer
+	err := cfg.run(&out)
+	if err == nil {
+		t.Fatal("expected an error for an invalid line selection")
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("nothing should be written on a fatal error, got:\n%s", out.String())
+	}
+
+	if err := writeJSONErrors(&out, err); err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %s\n%s", err, out.String())
+	}
+
+	want := []string{"line selection is invalid"}
+	if !reflect.DeepEqual(got.Errors, want) {
+		t.Errorf("got:\n%q\nwant:\n%q", got.Errors, want)
+	}
+}
+
+func TestMappingReport(t *testing.T) {
+	cfg := &config{
+		add:           []string{"json", "xml"},
+		output:        "source",
+		all:           true,
+		transform:     "camelcase",
+		quiet:         true,
+		file:          filepath.Join(fixtureDir, "mapping_report.input"),
+		mappingReport: filepath.Join(t.TempDir(), "mapping.json"),
+	}
+
+	if err := cfg.run(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(cfg.mappingReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]map[string]string
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"foo": {
+			"UserName": "userName",
+			"Email":    "mail",
+			"Address":  "address",
+		},
+		"Address": {
+			"Street": "street",
+		},
+		"bar": {
+			"ID": "id",
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestForce(t *testing.T) {
+	cfg := &config{
+		file: filepath.Join(fixtureDir, "struct_force.input"),
+	}
+
+	if _, err := cfg.parse(); err == nil {
+		t.Fatal("expected a parse error without -force")
+	}
+
+	cfg = &config{
+		file:  cfg.file,
+		force: true,
+	}
+
+	if _, err := cfg.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.parseErrors) == 0 {
+		t.Error("the parse errors should be kept as warnings")
+	}
+}
+
+func TestPrintPositions(t *testing.T) {
+	cfg := &config{
+		file: filepath.Join(fixtureDir, "offset_nested_struct.input"),
+	}
+
+	node, err := cfg.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cfg.printPositions(&out, node)
+
+	want := `struct foo: lines 3-10, offsets 22-110
+	field Name: line 4, column 2, offset 32
+	field Address: line 5, column 2, offset 48
+	field Age: line 9, column 2, offset 101
+struct Address: lines 5-8, offsets 56-99
+	field Street: line 6, column 3, offset 67
+	field City: line 7, column 3, offset 83
+`
+
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tests := []struct {
+		add     string
+		want    string
+		wantErr error
+	}{
+		{add: "yaml", want: "1 field would be modified\n", wantErr: errDryRun},
+		{add: "json", want: "0 fields would be modified\n"},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.add, func(t *testing.T) {
+			cfg := &config{
+				add:        []string{ts.add},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+				dryRun:     true,
+				file:       filepath.Join(fixtureDir, "struct_add_explicit_value.golden"),
+			}
+
+			var out bytes.Buffer
+			if err := cfg.run(&out); err != ts.wantErr {
+				t.Fatalf("got error: %v, want: %v", err, ts.wantErr)
+			}
+
+			if out.String() != ts.want {
+				t.Errorf("got: %q, want: %q", out.String(), ts.want)
+			}
+		})
+	}
+}
+
+func TestNoWriteOnError(t *testing.T) {
+	src := "package foo\n\ntype foo struct {\n\tName  string\n\tEmail string `json:email`\n}\n"
+	written := "package foo\n\ntype foo struct {\n\tName  string `json:\"name\"`\n\tEmail string `json:email`\n}\n"
+
+	tests := []struct {
+		noWriteOnError bool
+		want           string
+		wantErr        bool
+	}{
+		{noWriteOnError: false, want: written},
+		{noWriteOnError: true, want: src, wantErr: true},
+	}
+
+	for _, ts := range tests {
+		t.Run(fmt.Sprintf("no-write-on-error=%t", ts.noWriteOnError), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "foo.go")
+			if err := ioutil.WriteFile(file, []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &config{
+				add:            []string{"json"},
+				output:         "source",
+				structName:     "foo",
+				transform:      "snakecase",
+				file:           file,
+				write:          true,
+				quiet:          true,
+				noWriteOnError: ts.noWriteOnError,
+			}
+
+			// the skipped write fails the run
+			if err := cfg.run(ioutil.Discard); (err != nil) != ts.wantErr {
+				t.Fatalf("got error: %v, want error: %t", err, ts.wantErr)
+			}
+
+			got, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != ts.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, ts.want)
+			}
+		})
+	}
+}
+
+func TestAddOptionsStable(t *testing.T) {
+	src := "package foo\n\ntype foo struct {\n\tName string `yaml:\"name\" xml:\"name\" json:\"name\"`\n}\n"
+	want := "package foo\n\ntype foo struct {\n\tName string `yaml:\"name,flow,inline\" xml:\"name,attr\" json:\"name,string,omitempty\"`\n}\n"
+
+	// the options are added in the given order, for each key, on every run
+	for i := 0; i < 20; i++ {
+		cfg := &config{
+			addOptions: []string{"json=string", "xml=attr", "yaml=flow", "json=omitempty", "yaml=inline"},
+			output:     "source",
+			all:        true,
+			file:       stdinFilename,
+			stdin:      strings.NewReader(src),
+		}
+
+		var out bytes.Buffer
+		if err := cfg.run(&out); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := out.String(); got != want+"\n" {
+			t.Fatalf("run %d:\ngot:\n%s\nwant:\n%s", i, got, want)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	src := "package foo\n\ntype foo struct {\n\tName string\n}\n"
+	want := "package foo\n\ntype foo struct {\n\tName string `json:\"name\"`\n}\n"
+
+	tests := []struct {
+		includeTests bool
+		modified     []string
+	}{
+		{modified: []string{"a.go", "sub/c.go"}},
+		{includeTests: true, modified: []string{"a.go", "b_test.go", "sub/c.go"}},
+	}
+
+	for _, ts := range tests {
+		t.Run(fmt.Sprintf("include-tests=%t", ts.includeTests), func(t *testing.T) {
+			dir := t.TempDir()
+			files := []string{"a.go", "b_test.go", "sub/c.go", "vendor/d.go", "testdata/e.go"}
+			for _, name := range append(files, "bad.go") {
+				file := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+					t.Fatal(err)
+				}
+
+				data := src
+				if name == "bad.go" {
+					data = "package foo\n\ntype bar struct {\n"
+				}
+
+				if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg := &config{
+				add:          []string{"json"},
+				output:       "source",
+				transform:    "snakecase",
+				dir:          dir,
+				includeTests: ts.includeTests,
+				write:        true,
+				quiet:        true,
+			}
+
+			// the file with a syntax error doesn't stop the other files
+			err := cfg.runDir(ioutil.Discard)
+			rwErrs, ok := err.(*rewriteErrors)
+			if !ok || len(rwErrs.errs) != 1 || !strings.Contains(rwErrs.Error(), "bad.go") {
+				t.Fatalf("expected an error for bad.go, got: %v", err)
+			}
+
+			for _, name := range files {
+				got, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				exp := src
+				for _, m := range ts.modified {
+					if m == name {
+						exp = want
+					}
+				}
+
+				if string(got) != exp {
+					t.Errorf("%s:\ngot:\n%s\nwant:\n%s", name, got, exp)
+				}
+			}
+		})
+	}
+
+	t.Run("output", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &config{
+			add:       []string{"json"},
+			output:    "source",
+			transform: "snakecase",
+			dir:       dir,
+		}
+
+		// the sources of the files would be printed back to back
+		if err := cfg.validate(); err == nil {
+			t.Fatal("-dir without -w, -quiet, -stat, -dry-run or -format diff should be rejected")
+		}
+
+		// the edits of the written files aren't printed either
+		cfg.write = true
+		for _, output := range []string{"json", "json-per-struct", "text-edits"} {
+			cfg.output = output
+			if err := cfg.validate(); err == nil {
+				t.Errorf("-dir -w -format %s should be rejected", output)
+			}
+		}
+
+		// the written files aren't printed
+		cfg.output = "source"
+
+		var out bytes.Buffer
+		if err := cfg.runDir(&out); err != nil {
+			t.Fatal(err)
+		}
+
+		if out.Len() != 0 {
+			t.Errorf("got output:\n%s", out.String())
+		}
+	})
+}
+
+func TestDirFilePattern(t *testing.T) {
+	src := "package foo\n\ntype foo struct {\n\tName string\n}\n"
+	want := "package foo\n\ntype foo struct {\n\tName string `json:\"name\"`\n}\n"
+
+	tests := []struct {
+		pattern  string
+		modified []string
+	}{
+		{pattern: "*_linux.go", modified: []string{"a_linux.go", "sub/b_linux.go"}},
+		{pattern: "sub/*_windows.go", modified: []string{"sub/b_windows.go"}},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.pattern, func(t *testing.T) {
+			dir := t.TempDir()
+			files := []string{"a.go", "a_linux.go", "a_windows.go", "sub/b_linux.go", "sub/b_windows.go"}
+			for _, name := range files {
+				file := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := ioutil.WriteFile(file, []byte(src), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg := &config{
+				add:         []string{"json"},
+				output:      "source",
+				transform:   "snakecase",
+				dir:         dir,
+				filePattern: ts.pattern,
+				write:       true,
+			}
+
+			if err := cfg.runDir(ioutil.Discard); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range files {
+				got, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				exp := src
+				for _, m := range ts.modified {
+					if m == name {
+						exp = want
+					}
+				}
+
+				if string(got) != exp {
+					t.Errorf("%s:\ngot:\n%s\nwant:\n%s", name, got, exp)
+				}
+			}
+		})
+	}
+
+	t.Run("without dir", func(t *testing.T) {
+		cfg := &config{
+			add:         []string{"json"},
+			output:      "source",
+			file:        "demo.go",
+			all:         true,
+			filePattern: "*_linux.go",
+		}
+
+		if err := cfg.validate(); err == nil {
+			t.Error("-file-pattern without -dir should be rejected")
+		}
+	})
+}
+
+func TestDirSkipInterfaces(t *testing.T) {
+	src := "package foo\n\nimport \"io\"\n\ntype %s struct {\n\tName string\n\tBody io.Reader\n}\n"
+	want := "package foo\n\nimport \"io\"\n\ntype %s struct {\n\tName string `json:\"name\"`\n\tBody io.Reader\n}\n"
+
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".go"), []byte(fmt.Sprintf(src, name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config{
+		add:                 []string{"json"},
+		output:              "source",
+		transform:           "snakecase",
+		dir:                 dir,
+		write:               true,
+		skipInterfaceFields: true,
+	}
+
+	if err := cfg.runDir(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name+".go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != fmt.Sprintf(want, name) {
+			t.Errorf("%s.go:\ngot:\n%s\nwant:\n%s", name, got, fmt.Sprintf(want, name))
+		}
+	}
+
+	// the package imported by both files is type checked once
+	if cfg.importer == nil || len(cfg.importer.packages) != 1 {
+		t.Errorf("the imported packages aren't shared by the files: %v", cfg.importer)
+	}
+}
+
+func TestDirStats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go":     "package foo\n\ntype foo struct {\n\tName string\n}\n\ntype bar struct {\n\tName string `json:\"name\"`\n}\n",
+		"b.go":     "package foo\n\ntype qux struct {\n\tName string `json:\"name\"`\n}\n",
+		"sub/c.go": "package sub\n\ntype foo struct {\n\tName struct {\n\t\tFirst string\n\t}\n}\n",
+	}
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config{
+		add:       []string{"json"},
+		output:    "source",
+		transform: "snakecase",
+		dir:       dir,
+		stats:     true,
+		quiet:     true,
+	}
+
+	// without -w the files are left as they are
+	var out bytes.Buffer
+	if err := cfg.runDir(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "scanned 3 files, 5 structs, would modify 2 files\n"
+	if out.String() != want {
+		t.Errorf("got: %q, want: %q", out.String(), want)
+	}
+
+	// -stat prints the changes of each file in front of the summary
+	cfg.quiet = false
+	cfg.stat = true
+	out.Reset()
+	if err := cfg.runDir(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(out.String(), "\n"+want) {
+		t.Errorf("got: %q, want the summary: %q", out.String(), want)
+	}
+
+	cfg.stat = false
+	cfg.quiet = true
+	cfg.write = true
+	out.Reset()
+	if err := cfg.runDir(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want = "scanned 3 files, 5 structs, modified 2 files\n"
+	if out.String() != want {
+		t.Errorf("got: %q, want: %q", out.String(), want)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	cfg := &config{
+		add:       []string{"json"},
+		output:    "source",
+		all:       true,
+		transform: "snakecase",
+		file:      stdinFilename,
+		stdin:     strings.NewReader("package foo\n\ntype foo struct {\n\tName string\n}\n"),
+	}
+
+	var out bytes.Buffer
+	if err := cfg.run(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "package foo\n\ntype foo struct {\n\tName string `json:\"name\"`\n}\n\n"
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	// there is no file to write to
+	cfg.write = true
+	if err := cfg.validate(); err == nil {
+		t.Error("-stdin together with -w should be rejected")
+	}
+}
+
+func TestValidateSelection(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *config
+		err  string
+	}{
+		{
+			name: "none",
+			cfg:  &config{},
+			err:  errNoSelection.Error(),
+		},
+		{
+			name: "line and struct",
+			cfg:  &config{line: "4,6", structName: "foo"},
+		},
+		{
+			name: "struct and struct-with-comment",
+			cfg:  &config{structName: "foo", structComment: "+tags"},
+			err:  "-struct and -struct-with-comment cannot be used together. pick one",
+		},
+		{
+			name: "line, struct-regex and struct-implements",
+			cfg:  &config{line: "4", structRegex: regexp.MustCompile("^foo"), structImplements: "Validate"},
+			err:  "-line, -struct-regex and -struct-implements cannot be used together. pick one",
+		},
+		{
+			name: "targets and all",
+			cfg:  &config{targets: []string{"foo"}, all: true},
+			err:  "-targets and -all cannot be used together. pick one",
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			ts.cfg.file = "demo.go"
+			ts.cfg.add = []string{"json"}
+			ts.cfg.output = "source"
+
+			err := ts.cfg.validate()
+			if ts.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			if err == nil || err.Error() != ts.err {
+				t.Errorf("got error: %v, want: %s", err, ts.err)
+			}
+		})
+	}
+}
+
+func TestValidateEditor(t *testing.T) {
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{
+			name: "editor",
+			args: []string{"-editor"},
+		},
+		{
+			name: "write",
+			args: []string{"-editor", "-w"},
+			err:  "-editor writes a JSON response, it cannot be used together with -w, -quiet, -stat, -dry-run or -format",
+		},
+		{
+			name: "format",
+			args: []string{"-editor", "-format", "json"},
+			err:  "-editor writes a JSON response, it cannot be used together with -w, -quiet, -stat, -dry-run or -format",
+		},
+		{
+			name: "file",
+			args: []string{"-editor", "-file", "demo.go"},
+			err:  "-editor cannot be used together with -file, -dir, -stdin or -modified",
+		},
+		{
+			name: "add tags",
+			args: []string{"-editor", "-add-tags", "json"},
+			err:  "-editor reads the selection and the operations from the request, they cannot be passed as flags",
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet("gomodifytags", flag.ContinueOnError)
+			flag.CommandLine.SetOutput(ioutil.Discard)
+
+			cfg, err := parseConfig(ts.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = cfg.validate()
+			if ts.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			if err == nil || err.Error() != ts.err {
+				t.Errorf("got error: %v, want: %s", err, ts.err)
+			}
+		})
+	}
+}
+
+func TestFragment(t *testing.T) {
+	src := "// foo is a snippet.\ntype foo struct {\n\tName  string\n\tEmail string\n}\n"
+
+	tests := []struct {
+		name string
+		cfg  *config
+		want string
+	}{
+		{
+			name: "line",
+			cfg:  &config{line: "4"},
+			want: "// foo is a snippet.\ntype foo struct {\n\tName  string\n\tEmail string `json:\"email\"`\n}\n\n",
+		},
+		{
+			name: "offset",
+			cfg:  &config{offset: 40},
+			want: "// foo is a snippet.\ntype foo struct {\n\tName  string `json:\"name\"`\n\tEmail string `json:\"email\"`\n}\n\n",
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			cfg := ts.cfg
+			cfg.add = []string{"json"}
+			cfg.output = "source"
+			cfg.transform = "snakecase"
+			cfg.file = stdinFilename
+			cfg.stdin = strings.NewReader(src)
+			cfg.fragment = true
+
+			var out bytes.Buffer
+			if err := cfg.run(&out); err != nil {
+				t.Fatal(err)
+			}
+
+			if out.String() != ts.want {
+				t.Errorf("got:\n%s\nwant:\n%s", out.String(), ts.want)
+			}
+		})
+	}
+}
+
+func TestEditorDefaultTransform(t *testing.T) {
+	// an omitted transform is intentionally snakecase, as the -transform
+	// flag, and not an unknown transform
+	tests := []struct {
+		transform string
+		want      string
+	}{
+		{transform: "", want: `json:"field_name"`},
+		{transform: "keep", want: `json:"FieldName"`},
+	}
+
+	for _, ts := range tests {
+		req := &editorRequest{
+			File:       "unsaved.go",
+			Source:     "package foo\n\ntype foo struct {\n\tFieldName string\n}\n",
+			Selection:  editorSelection{Struct: "foo"},
+			Operations: editorOperations{AddTags: []string{"json"}, Transform: ts.transform},
+		}
+
+		edits, err := req.config().editorEdits()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(edits) != 1 || !strings.Contains(edits[0].NewText, ts.want) {
+			t.Errorf("transform %q: got edits %+v, want %s", ts.transform, edits, ts.want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	var explain bytes.Buffer
+	cfg := &config{
+		add:              []string{"json", "xml"},
+		output:           "source",
+		structName:       "foo",
+		transform:        "snakecase",
+		valueFormatByKey: map[string]string{"xml": "{field},attr"},
+		explain:          &explain,
+		quiet:            true,
+		file:             filepath.Join(fixtureDir, "struct_add_explicit_value.input"),
+	}
+
+	if err := cfg.run(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `foo.FieldName: json:"field_name" by transform snakecase
+foo.FieldName: xml:"field_name,attr" by transform snakecase, -template-by-key "{field},attr"
+`
+
+	if explain.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", explain.String(), want)
+	}
+}
+
+func TestDiffStat(t *testing.T) {
+	cfg := &config{
+		add:       []string{"json"},
+		output:    "source",
+		all:       true,
+		transform: "snakecase",
+		stat:      true,
+		file:      filepath.Join(fixtureDir, "struct_targets.input"),
+	}
+
+	var out bytes.Buffer
+	if err := cfg.run(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := cfg.file + ": +6 -6, 1 hunk\n"
+	if out.String() != want {
+		t.Errorf("got: %q, want: %q", out.String(), want)
+	}
+
+	// changes more than twice the context apart are separate hunks
+	a := []string{"a", "1", "2", "3", "4", "5", "6", "7", "b"}
+	b := []string{"A", "1", "2", "3", "4", "5", "6", "7", "B"}
+	if hunks := diffHunks(diffLines(a, b), 3); len(hunks) != 2 {
+		t.Errorf("got %d hunks, want 2", len(hunks))
+	}
+}
+
+func TestWrite(t *testing.T) {
+	input, err := ioutil.ReadFile(filepath.Join(fixtureDir, "struct_add.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "struct_add.go")
+	if err := ioutil.WriteFile(file, input, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure the umask doesn't interfere
+	if err := os.Chmod(file, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config{
+		add:        []string{"json"},
+		output:     "source",
+		structName: "foo",
+		transform:  "snakecase",
+		write:      true,
+		file:       file,
+	}
+
+	node, err := cfg.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, end, err := cfg.findSelection(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrittenNode, err := cfg.rewrite(node, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cfg.format(rewrittenNode, err); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := ioutil.ReadFile(filepath.Join(fixtureDir, "struct_add.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("got:\n====\n%s\nwant:\n====\n%s\n", got, want)
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("file mode is not preserved, got: %v, want: %v", fi.Mode().Perm(), os.FileMode(0640))
+	}
+
+	// the temporary file should be renamed to the file
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("temporary files are left behind: %v", names)
+	}
+}
+
+func TestWriteBOM(t *testing.T) {
+	input, err := ioutil.ReadFile(filepath.Join(fixtureDir, "struct_add_bom.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "struct_add_bom.go")
+	if err := ioutil.WriteFile(file, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config{
+		add:        []string{"json"},
+		output:     "source",
+		structName: "foo",
+		transform:  "snakecase",
+		write:      true,
+		quiet:      true,
+		file:       file,
+	}
+
+	if err := cfg.run(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, ts := range test {
-		t.Run(ts.file, func(t *testing.T) {
-			ts.cfg.file = filepath.Join(fixtureDir, fmt.Sprintf("%s.input", ts.file))
-			// these are explicit and shouldn't be changed for this particular
-			// main test
-			ts.cfg.output = "json"
-			ts.cfg.transform = "camelcase"
+	want, err := ioutil.ReadFile(filepath.Join(fixtureDir, "struct_add_bom.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			node, err := ts.cfg.parse()
-			if err != nil {
-				t.Fatal(err)
-			}
+	if !bytes.Equal(got, append(append([]byte{}, utf8BOM...), want...)) {
+		t.Errorf("the BOM should be kept, got:\n%q", got)
+	}
+}
 
-			start, end, err := ts.cfg.findSelection(node)
-			if err != nil {
-				t.Fatal(err)
-			}
+func TestTestFile(t *testing.T) {
+	input, err := ioutil.ReadFile(filepath.Join(fixtureDir, "struct_test_file.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			rewrittenNode, err := ts.cfg.rewrite(node, start, end)
-			if err != nil {
-				if _, ok := err.(*rewriteErrors); !ok {
-					t.Fatal(err)
-				}
-			}
+	// test files are only processed when they are named explicitly
+	file := filepath.Join(t.TempDir(), "helpers_test.go")
+	if err := ioutil.WriteFile(file, input, 0644); err != nil {
+		t.Fatal(err)
+	}
 
-			out, err := ts.cfg.format(rewrittenNode, err)
-			if !reflect.DeepEqual(err, ts.err) {
-				t.Logf("want: %v", ts.err)
-				t.Logf("got: %v", err)
-				t.Fatalf("unexpected error")
-			}
+	cfg := &config{
+		add:        []string{"json"},
+		output:     "source",
+		structName: "testCase",
+		transform:  "snakecase",
+		write:      true,
+		quiet:      true,
+		file:       file,
+	}
 
-			if ts.err != nil {
-				return
-			}
+	if err := cfg.run(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
 
-			got := []byte(out)
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			// update golden file if necessary
-			golden := filepath.Join(fixtureDir, fmt.Sprintf("%s.golden", ts.file))
-			if *update {
-				err := ioutil.WriteFile(golden, got, 0644)
-				if err != nil {
-					t.Error(err)
-				}
-				return
+	want, err := ioutil.ReadFile(filepath.Join(fixtureDir, "struct_test_file.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteFileMode(t *testing.T) {
+	modes := []os.FileMode{0600, 0644, 0755, 0444}
+
+	for _, mode := range modes {
+		mode := mode
+
+		t.Run(mode.String(), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "foo.go")
+			if err := ioutil.WriteFile(file, []byte("package foo\n"), mode); err != nil {
+				t.Fatal(err)
 			}
 
-			// get golden file
-			want, err := ioutil.ReadFile(golden)
-			if err != nil {
+			// make sure the umask doesn't interfere
+			if err := os.Chmod(file, mode); err != nil {
 				t.Fatal(err)
 			}
 
-			from, err := ioutil.ReadFile(ts.cfg.file)
+			if err := writeFile(file, []byte("package bar\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(file)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			// compare
-			if !bytes.Equal(got, want) {
-				t.Errorf("case %s\ngot:\n====\n\n%s\nwant:\n=====\n\n%s\nfrom:\n=====\n\n%s\n",
-					ts.file, got, want, from)
+			if fi.Mode() != mode {
+				t.Errorf("got mode: %v, want: %v", fi.Mode(), mode)
 			}
 		})
 	}
 }
 
-func TestModifiedRewrite(t *testing.T) {
-	cfg := &config{
-		add:        []string{"json"},
-		output:     "source",
-		structName: "foo",
-		transform:  "snakecase",
-		file:       "struct_add_modified",
-		modified: strings.NewReader(`struct_add_modified
-55
-package foo
+func TestWriteFileNotExist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "foo.go")
+	if err := writeFile(file, []byte("package foo\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode() != 0644 {
+		t.Errorf("got mode: %v, want: %v", fi.Mode(), os.FileMode(0644))
+	}
+}
+
+func TestWriteFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target", "foo.go")
+	if err := os.Mkdir(filepath.Dir(target), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(target, []byte("package foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "foo.go")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks aren't supported: %v", err)
+	}
+
+	if err := writeFile(link, []byte("package bar\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the link is kept and the file it points to is replaced
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("%s is replaced with a regular file", link)
+	}
+
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "package bar\n" {
+		t.Errorf("got:\n%s\nwant:\npackage bar", got)
+	}
+}
+
+func TestNameCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	command := filepath.Join(dir, "name.sh")
+	script := `#!/bin/sh
+read struct
+read field
+if [ "$field" = "fail" ]; then
+	echo "unknown field" >&2
+	exit 1
+fi
+echo "${struct}_${field}"
+`
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "foo.go")
+	src := `package foo
 
 type foo struct {
-	bar string
-	t   bool
+	bar  string
+	t    bool
+	fail int
 }
-`),
+`
+	if err := ioutil.WriteFile(file, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config{
+		add:         []string{"json"},
+		output:      "source",
+		line:        "4,5",
+		transform:   "snakecase",
+		nameCommand: command,
+		file:        file,
 	}
 
 	node, err := cfg.parse()
@@ -834,40 +3134,125 @@ type foo struct {
 		t.Fatal(err)
 	}
 
-	golden := filepath.Join(fixtureDir, "struct_add.golden")
-	want, err := ioutil.ReadFile(golden)
-	if err != nil {
-		t.Fatal(err)
-	}
+	want := `package foo
 
-	// compare
-	if !bytes.Equal([]byte(got), want) {
+type foo struct {
+	bar  string ` + "`json:\"foo_bar\"`" + `
+	t    bool   ` + "`json:\"foo_t\"`" + `
+	fail int
+}
+`
+	if got != want {
 		t.Errorf("got:\n====\n%s\nwant:\n====\n%s\n", got, want)
 	}
-}
 
-func TestModifiedFileMissing(t *testing.T) {
-	cfg := &config{
-		add:        []string{"json"},
-		output:     "source",
-		structName: "foo",
-		transform:  "snakecase",
-		file:       "struct_add_modified",
-		modified: strings.NewReader(`file_that_doesnt_exist
-55
-package foo
+	t.Run("failure", func(t *testing.T) {
+		_, err := cfg.runNameCommand(fieldInfo{structName: "foo", name: "fail"})
+		if err == nil {
+			t.Fatal("expected error for a non-zero exit")
+		}
 
-type foo struct {
-	bar string
-	t   bool
+		if !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("error doesn't contain the stderr of the command: %v", err)
+		}
+	})
+
+	t.Run("blank", func(t *testing.T) {
+		defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+		flag.CommandLine = flag.NewFlagSet("gomodifytags", flag.ContinueOnError)
+		flag.CommandLine.SetOutput(ioutil.Discard)
+
+		_, err := parseConfig([]string{"-file", file, "-name-command", " "})
+		if err == nil {
+			t.Fatal("expected error for a blank -name-command")
+		}
+	})
 }
-`),
+
+func TestStamp(t *testing.T) {
+	now := func() time.Time {
+		return time.Date(2024, 7, 15, 10, 0, 0, 0, time.UTC)
 	}
 
-	_, err := cfg.parse()
-	if err == nil {
-		t.Fatal("expected error")
+	for _, file := range []string{"stamp", "stamp_existing", "stamp_header"} {
+		t.Run(file, func(t *testing.T) {
+			cfg := &config{
+				add:        []string{"json"},
+				output:     "source",
+				structName: "foo",
+				transform:  "snakecase",
+				stamp:      true,
+				now:        now,
+				file:       filepath.Join(fixtureDir, fmt.Sprintf("%s.input", file)),
+			}
+
+			node, err := cfg.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start, end, err := cfg.findSelection(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rewrittenNode, err := cfg.rewrite(node, start, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := cfg.format(rewrittenNode, err)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join(fixtureDir, fmt.Sprintf("%s.golden", file))
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != string(want) {
+				t.Errorf("got:\n====\n%s\nwant:\n====\n%s\n", got, want)
+			}
+
+			// running it again must not add a second stamp
+			if again := string(cfg.addStamp([]byte(got))); again != got {
+				t.Errorf("stamp is not idempotent:\n%s", again)
+			}
+		})
 	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		src := "package foo\n\ntype foo struct {\n\tbar string `json:\"bar\"`\n}\n"
+		cfg := &config{
+			add:        []string{"json"},
+			output:     "source",
+			structName: "foo",
+			transform:  "snakecase",
+			stamp:      true,
+			now:        now,
+			file:       stdinFilename,
+			stdin:      strings.NewReader(src),
+		}
+
+		var out bytes.Buffer
+		if err := cfg.run(&out); err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(out.String(), stampPrefix) {
+			t.Errorf("stamp is added without any modified tag:\n%s", out.String())
+		}
+	})
 }
 
 func TestParseLines(t *testing.T) {
@@ -937,6 +3322,31 @@ func TestParseLines(t *testing.T) {
 	}
 }
 
+func TestReadTargets(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "targets.txt")
+	if err := ioutil.WriteFile(filename, []byte("foo.Name\n\n  bar.Note  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := readTargets(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"foo.Name", "bar.Note"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("got: %q, want: %q", targets, want)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readTargets(filename); err == nil {
+		t.Error("expected an error for a file without targets")
+	}
+}
+
 func TestParseConfig(t *testing.T) {
 	// don't output help message during the test
 	flag.CommandLine.SetOutput(ioutil.Discard)
@@ -949,3 +3359,79 @@ func TestParseConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUsage(t *testing.T) {
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	for _, args := range [][]string{{"-h"}, {}} {
+		var out bytes.Buffer
+		flag.CommandLine = flag.NewFlagSet("gomodifytags", flag.ContinueOnError)
+		flag.CommandLine.SetOutput(&out)
+
+		if _, err := parseConfig(args); err != flag.ErrHelp {
+			t.Fatalf("%q: got error %v, want %v", args, err, flag.ErrHelp)
+		}
+
+		if !strings.Contains(out.String(), "-add-tags") {
+			t.Errorf("%q: the usage doesn't list -add-tags:\n%s", args, out.String())
+		}
+
+		for name := range hiddenFlags {
+			if strings.Contains(out.String(), "-"+name) {
+				t.Errorf("%q: the usage lists the hidden flag -%s", args, name)
+			}
+		}
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+
+	file := filepath.Join(t.TempDir(), "gomodifytags.json")
+	data := `{
+	// the defaults of the team
+	"transform": "camelcase",
+	"add-options": ["json=omitempty", "xml=attr"],
+	"sort": true
+}`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	flag.CommandLine = flag.NewFlagSet("gomodifytags", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(ioutil.Discard)
+
+	cfg, err := parseConfig([]string{"-config", file, "-file", "foo.go", "-transform", "snakecase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the flags win over the config file, which wins over the defaults
+	if cfg.transform != "snakecase" {
+		t.Errorf("transform: got %q, want %q", cfg.transform, "snakecase")
+	}
+
+	if want := []string{"json=omitempty", "xml=attr"}; !reflect.DeepEqual(cfg.addOptions, want) {
+		t.Errorf("add options: got %q, want %q", cfg.addOptions, want)
+	}
+
+	if !cfg.sort {
+		t.Error("sort: got false, want true")
+	}
+
+	if cfg.insertPosition != "end" {
+		t.Errorf("insert position: got %q, want %q", cfg.insertPosition, "end")
+	}
+
+	if err := ioutil.WriteFile(file, []byte(`{"transfrom": "camelcase"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	flag.CommandLine = flag.NewFlagSet("gomodifytags", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(ioutil.Discard)
+
+	_, err = parseConfig([]string{"-config", file, "-file", "foo.go"})
+	if err == nil || !strings.Contains(err.Error(), `unknown flag "transfrom"`) {
+		t.Errorf("expected an unknown flag error, got: %v", err)
+	}
+}